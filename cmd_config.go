@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// cmdConfig prints the config of an environment, as it is used by the other
+// commands: merged with the environments it extends, with the environment's
+// Marathon settings applied to marathon & references expanded
+func cmdConfig(f flags) error {
+	conf, err := cmdLoadConfig(f)
+	if err != nil {
+		return err
+	}
+	env := conf.Environments[f.env]
+	env.Extends = ""
+	env.Marathon.configMarathon = configMarathon{}
+	conf.Environments = map[string]configEnvironment{f.env: env}
+	output, err := yaml.Marshal(conf)
+	if err != nil {
+		return fmt.Errorf("Error formatting config: %s", err)
+	}
+	fmt.Fprintf(stdout, "%s", output)
+	return nil
+}
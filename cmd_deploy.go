@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+func cmdDeploy(f flags) error {
+
+	// Load config, check images & prepare Marathon JSON config
+	m, err := cmdLoadMarathon(f, true)
+	if err != nil {
+		return err
+	}
+	conf, group := m.conf, m.group
+
+	// Print info
+	cmdPrintInfo(f, conf, m.vars)
+	if f.verbose {
+		printConfig, err := redactGroupJSON(m.jsonConfig)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Marathon Config: %s\n", printConfig)
+	}
+
+	// Show changes compared to the group currently in Marathon
+	if f.diff {
+		err = cmdPrintDiff(conf, group)
+		if err != nil {
+			log.Printf("Unable to show Marathon changes: %s\n", err)
+		}
+	}
+
+	// Confirm we should send request
+	if !cmdConfirm(f, "Deploy?") {
+		return cmdErrorf(exitCancelled, "Deployment cancelled")
+	}
+
+	// Remember current group version so we can roll back
+	var previousVersion string
+	if f.rollback {
+		previousVersion, err = marathonGroupVersion(conf, group.ID)
+		if err != nil {
+			return fmt.Errorf("Error getting current Marathon group version:\n%s", err)
+		}
+		fmt.Fprintf(stdout, "Rollback Version: %s\n", previousVersion)
+	}
+
+	// Deploy JSON config to Marathon
+	result, err := marathonPush(
+		conf,
+		m.jsonConfig,
+		f.marathonForce,
+	)
+	if err != nil {
+		return fmt.Errorf("Marathon deploy error:\n%s", err)
+	}
+	log.Printf("Deployed to marathon:\n%+v\n", result)
+
+	// Wait for deployment to finish
+	err = cmdWatch(f, group.ID, conf, result)
+	if err == nil || !f.rollback {
+		return err
+	}
+
+	return cmdRollbackFailed(f, conf, group.ID, result, previousVersion, err)
+
+}
+
+// cmdRollbackFailed cancels a failed deployment and restores the previous
+// version of the group. If the group didn't exist before the deployment there
+// is nothing to restore, so the deployment is only cancelled.
+func cmdRollbackFailed(f flags, conf config, groupID string, result marathonResult, previousVersion string, watchErr error) error {
+	if previousVersion == "" {
+		log.Printf("%s\nCancelling deployment %s\n", watchErr, result.DeploymentID)
+		err := marathonCancelDeployment(conf, result.DeploymentID)
+		if err != nil {
+			return fmt.Errorf(
+				"Error cancelling deployment %s:\n%s",
+				result.DeploymentID,
+				err,
+			)
+		}
+		return cmdErrorf(
+			exitFailed,
+			"Marathon deployment failed, cancelled deployment %s (no previous version to roll back to)",
+			result.DeploymentID,
+		)
+	}
+	log.Printf("%s\nRolling back to %s\n", watchErr, previousVersion)
+	rollbackResult, err := marathonRollback(
+		conf,
+		groupID,
+		result.DeploymentID,
+		previousVersion,
+	)
+	if err != nil {
+		return fmt.Errorf("Marathon rollback error:\n%s", err)
+	}
+	err = marathonWatch(conf, groupID, rollbackResult, f.marathonTimeout)
+	if err != nil {
+		return cmdErrorf(exitFailed, "Marathon rollback failed:\n%s", err)
+	}
+	return cmdErrorf(exitFailed, "Marathon deployment failed, rolled back to %s", previousVersion)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdRollbackFailed(t *testing.T) {
+	defer func(interval time.Duration, w io.Writer) {
+		marathonWatchInterval = interval
+		stdout = w
+		log.SetOutput(os.Stderr)
+	}(marathonWatchInterval, stdout)
+	marathonWatchInterval = time.Millisecond
+	log.SetOutput(ioutil.Discard)
+
+	tests := []struct {
+		previousVersion string
+		cancelStatus    int
+		group           string // group returned while watching the rollback
+		expect          []string
+		err             string
+	}{
+		// Cancel, re-deploy the previous version & wait for it
+		{
+			previousVersion: "v1",
+			cancelStatus:    200,
+			group:           `{"id":"/g","version":"v3","apps":[{"id":"/g/a","instances":1,"tasksRunning":1}]}`,
+			expect:          []string{"DELETE d1", "PUT v1", "GET /v2/deployments", "GET /v2/groups/g"},
+			err:             "Marathon deployment failed, rolled back to v1",
+		},
+		// Rollback replaced by another deployment
+		{
+			previousVersion: "v1",
+			cancelStatus:    404,
+			group:           `{"id":"/g","version":"v4"}`,
+			expect:          []string{"DELETE d1", "PUT v1", "GET /v2/deployments", "GET /v2/groups/g"},
+			err:             "Marathon rollback failed:\nDeployment d2 did not complete. Group /g is at version v4, expected v3",
+		},
+		// Group didn't exist before, so the deployment is only cancelled
+		{
+			cancelStatus: 200,
+			expect:       []string{"DELETE d1"},
+			err:          "Marathon deployment failed, cancelled deployment d1 (no previous version to roll back to)",
+		},
+		{
+			cancelStatus: 403,
+			expect:       []string{"DELETE d1"},
+			err:          "Error cancelling deployment d1:\nDELETE http://",
+		},
+	}
+	for i, test := range tests {
+		var requests []string
+		c, done := marathonTestServer(t, map[string]http.HandlerFunc{
+			"DELETE /v2/deployments/d1": func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, "DELETE d1")
+				w.WriteHeader(test.cancelStatus)
+			},
+			"PUT /v2/groups/g": func(w http.ResponseWriter, r *http.Request) {
+				var put struct {
+					Version string `json:"version"`
+				}
+				json.NewDecoder(r.Body).Decode(&put) // #nosec G104
+				requests = append(requests, "PUT "+put.Version)
+				w.Write([]byte(`{"deploymentId":"d2","version":"v3"}`)) // #nosec G104
+			},
+			"GET /v2/deployments": func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, "GET /v2/deployments")
+				w.Write([]byte(`[]`)) // #nosec G104
+			},
+			"GET /v2/groups/g": func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, "GET /v2/groups/g")
+				w.Write([]byte(test.group)) // #nosec G104
+			},
+		})
+		var buf bytes.Buffer
+		stdout = &buf
+		f := flags{marathonTimeout: time.Minute}
+		result := marathonResult{DeploymentID: "d1", Version: "v2"}
+		err := cmdRollbackFailed(f, c, "/g", result, test.previousVersion, errors.New("Marathon deployment failed"))
+		done()
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("(%d) Expected error '%s', got: %v", i, test.err, err)
+		}
+		if !reflect.DeepEqual(requests, test.expect) {
+			t.Errorf("(%d) Expected requests %q, got %q", i, test.expect, requests)
+		}
+	}
+}
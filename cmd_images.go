@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+func cmdImages(f flags) error {
+	conf, err := cmdLoadConfig(f)
+	if err != nil {
+		return err
+	}
+	images, err := dockerImageList(conf, f.env)
+	if err != nil {
+		return err
+	}
+	var digests map[string]string
+	if f.checkImages {
+		digests, err = dockerCheckImages(images, f.concurrency)
+	}
+	keys := make([]string, 0, len(images))
+	for key := range images {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		image := images[key]
+		switch digest, ok := digests[key]; {
+		case !f.checkImages:
+			fmt.Fprintf(stdout, "* %s = %s\n", key, image.String())
+		case ok:
+			fmt.Fprintf(stdout, "* %s = %s (%s)\n", key, image.String(), digest)
+		default:
+			fmt.Fprintf(stdout, "* %s = %s (not verified)\n", key, image.String())
+		}
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func cmdDiff(f flags) error {
+	m, err := cmdLoadMarathon(f, false)
+	if err != nil {
+		return err
+	}
+	cmdPrintInfo(f, m.conf, m.vars)
+	return cmdPrintDiff(m.conf, m.group)
+}
+
+func cmdStatus(f flags) error {
+	conf, groupID, err := cmdLoadGroupID(f)
+	if err != nil {
+		return err
+	}
+
+	// Get group & deployments
+	status, err := marathonGroupGetStatus(conf, groupID)
+	if err != nil {
+		return fmt.Errorf("Error getting Marathon group:\n%s", err)
+	}
+	deployments, err := marathonDeployments(conf)
+	if err != nil {
+		return fmt.Errorf("Error getting Marathon deployments:\n%s", err)
+	}
+
+	// Print deployments affecting the group
+	fmt.Fprintf(stdout, "Group: %s (version %s)\n", groupID, status.Version)
+	var deploying int
+	for _, deployment := range deployments {
+		for _, app := range deployment.AffectedApps {
+			if strings.HasPrefix(app, groupID+"/") {
+				if deploying == 0 {
+					fmt.Fprintf(stdout, "Deployments:\n")
+				}
+				fmt.Fprintf(
+					stdout,
+					"* %s (version %s) %s\n",
+					deployment.ID,
+					deployment.Version,
+					marathonDeploymentProgress(deployment),
+				)
+				deploying++
+				break
+			}
+		}
+	}
+
+	// Print app health
+	unhealthy := marathonUnhealthyApps(status)
+	if len(unhealthy) > 0 {
+		fmt.Fprintf(stdout, "Unhealthy Apps:\n* %s\n", strings.Join(unhealthy, "\n* "))
+	}
+	if deploying > 0 || len(unhealthy) > 0 {
+		return cmdErrorf(
+			exitFailed,
+			"Group %s has %d deployment(s) running and %d unhealthy app(s)",
+			groupID,
+			deploying,
+			len(unhealthy),
+		)
+	}
+	fmt.Fprintf(stdout, "All apps healthy\n")
+	return nil
+}
+
+func cmdHistory(f flags) error {
+	conf, groupID, err := cmdLoadGroupID(f)
+	if err != nil {
+		return err
+	}
+	current, err := marathonGroupVersion(conf, groupID)
+	if err != nil {
+		return fmt.Errorf("Error getting Marathon group:\n%s", err)
+	}
+	if current == "" {
+		return fmt.Errorf("Marathon group %s does not exist", groupID)
+	}
+	versions, err := marathonGroupVersions(conf, groupID)
+	if err != nil {
+		return fmt.Errorf("Error getting Marathon group versions:\n%s", err)
+	}
+	if f.historyLimit > 0 && len(versions) > f.historyLimit {
+		versions = versions[:f.historyLimit]
+	}
+	fmt.Fprintf(stdout, "Versions of %s:\n", groupID)
+	for _, version := range versions {
+		if version == current {
+			fmt.Fprintf(stdout, "* %s (current)\n", version)
+			continue
+		}
+		fmt.Fprintf(stdout, "* %s\n", version)
+	}
+	return nil
+}
+
+func cmdRollback(f flags) error {
+	conf, groupID, err := cmdLoadGroupID(f)
+	if err != nil {
+		return err
+	}
+
+	// Find version to roll back to
+	current, err := marathonGroupVersion(conf, groupID)
+	if err != nil {
+		return fmt.Errorf("Error getting Marathon group:\n%s", err)
+	}
+	if current == "" {
+		return fmt.Errorf("Marathon group %s does not exist", groupID)
+	}
+	version := f.rollbackVersion
+	if version == "" {
+		versions, err := marathonGroupVersions(conf, groupID)
+		if err != nil {
+			return fmt.Errorf("Error getting Marathon group versions:\n%s", err)
+		}
+		version = marathonPreviousVersion(versions, current)
+		if version == "" {
+			return fmt.Errorf("No version of %s older than %s found", groupID, current)
+		}
+	}
+
+	// Confirm & roll back
+	fmt.Fprintf(stdout, "Marathon URL: %s\n", marathonBaseURL(conf))
+	fmt.Fprintf(stdout, "Group: %s\n", groupID)
+	fmt.Fprintf(stdout, "Current Version: %s\n", current)
+	fmt.Fprintf(stdout, "Rollback Version: %s\n", version)
+	if !cmdConfirm(f, "Roll back?") {
+		return cmdErrorf(exitCancelled, "Rollback cancelled")
+	}
+	result, err := marathonRollback(conf, groupID, "", version)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Rolled back:\n%+v\n", result)
+	return cmdWatch(f, groupID, conf, result)
+}
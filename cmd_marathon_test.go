@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCmdLoadGroupID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // #nosec G104
+
+	files := map[string]string{
+		"deploy.yaml": `
+marathon: {host: marathon.example.com}
+git: {requireClean: true}
+metadata: {labels: true}
+image: {repository: registry.example.com, tagTemplate: "{{ .GitRevShort }}"}
+environments:
+  prod:
+    marathon: {file: marathon.yaml}
+    images:
+      web: {name: web, digest: true}
+`,
+		"marathon.yaml": `
+id: web
+apps:
+  - id: web
+    container: {type: DOCKER, docker: {image: "{{ .Images.web }}"}}
+`,
+	}
+	for name, data := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600)
+		if err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", name, err)
+		}
+	}
+
+	// Outside a git checkout, so tag templates, digests & metadata labels
+	// would all fail
+	defer gitStub(nil)()
+	f := flags{
+		env:        "prod",
+		configFile: "deploy.yaml",
+		configPath: filepath.Join(dir, "deploy.yaml"),
+		configDir:  dir,
+	}
+	conf, groupID, err := cmdLoadGroupID(f)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if groupID != "/web" {
+		t.Errorf("Expected group ID '/web', got '%s'", groupID)
+	}
+	if conf.Marathon.Host != "marathon.example.com" {
+		t.Errorf("Expected Marathon host 'marathon.example.com', got '%s'", conf.Marathon.Host)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// cmdRenderMarathon loads the config & renders the Marathon file without
+// contacting the Docker registry or Marathon
+func cmdRenderMarathon(f flags) (marathonGroup, []byte, error) {
+	conf, err := cmdLoadConfig(f)
+	if err != nil {
+		return marathonGroup{}, nil, err
+	}
+	vars, err := cmdLoadImages(f, conf, false)
+	if err != nil {
+		return marathonGroup{}, nil, err
+	}
+	group, jsonConfig, err := marathonPrepare(f, conf, vars)
+	if err != nil {
+		return marathonGroup{}, nil, fmt.Errorf("Error loading Marathon file: %s", err)
+	}
+	return group, jsonConfig, nil
+}
+
+func cmdRender(f flags) error {
+	_, jsonConfig, err := cmdRenderMarathon(f)
+	if err != nil {
+		return err
+	}
+	jsonConfig, err = redactGroupJSON(jsonConfig)
+	if err != nil {
+		return err
+	}
+	output, err := marathonFormat(jsonConfig, f.outputFormat)
+	if err != nil {
+		return err
+	}
+	return cmdWriteRendered(f.outputFile, output)
+}
+
+// cmdWriteRendered prints rendered output, or writes it to path if set.
+// Secret env vars & labels have already been hidden by key, so the output
+// isn't redacted further (which could make it unparseable), and is the
+// same whether it's printed or written to a file.
+func cmdWriteRendered(path string, output []byte) error {
+	if path == "" {
+		w := stdout
+		if r, ok := w.(redactWriter); ok {
+			w = r.w
+		}
+		_, err := w.Write(output)
+		return err
+	}
+	err := ioutil.WriteFile(path, output, 0644) // #nosec G306
+	if err != nil {
+		return fmt.Errorf("Error writing '%s': %s", path, err)
+	}
+	fmt.Fprintf(stderr, "Rendered Marathon file written to %s\n", path)
+	return nil
+}
+
+func cmdValidate(f flags) error {
+	group, _, err := cmdRenderMarathon(f)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Marathon group %s is valid\n", group.ID)
+	return nil
+}
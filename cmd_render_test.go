@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCmdWriteRendered(t *testing.T) {
+	defer func(w io.Writer) {
+		stdout = w
+		redactor.values = nil
+	}(stdout)
+	// A credential which happens to match a value in the output
+	redactAddValue("3600")
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // #nosec G104
+
+	output := []byte(`{"env": {"DB_PASSWORD": "[hidden]", "PORT": "3600"}}`)
+	expect := string(output)
+
+	// stdout & -out give the same output, without substrings replaced
+	var buf bytes.Buffer
+	stdout = redactWriter{&buf}
+	err = cmdWriteRendered("", output)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := buf.String(); got != expect {
+		t.Errorf("Expected stdout '%s', got '%s'", expect, got)
+	}
+	path := filepath.Join(dir, "rendered.json")
+	err = cmdWriteRendered(path, output)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	got, err := ioutil.ReadFile(path) // #nosec G304
+	if err != nil {
+		t.Fatalf("Unexpected error reading '%s': %s", path, err)
+	}
+	if string(got) != expect {
+		t.Errorf("Expected file '%s', got '%s'", expect, got)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK        = 0 // success
+	exitError     = 1 // general error e.g. invalid config, Marathon unreachable
+	exitUsage     = 2 // invalid command or flags
+	exitCancelled = 3 // cancelled at the confirmation prompt
+	exitFailed    = 4 // deployment failed or apps are unhealthy
+)
+
+// errHelp is returned by flags.parse when help was requested
+var errHelp = errors.New("help requested")
+
+// cmdError is an error which causes a specific exit code
+type cmdError struct {
+	code int
+	err  error
+}
+
+func (e cmdError) Error() string {
+	return e.err.Error()
+}
+
+func cmdErrorf(code int, format string, a ...interface{}) error {
+	return cmdError{code: code, err: fmt.Errorf(format, a...)}
+}
+
+// cmdExitCode returns the exit code for an error returned by a command
+func cmdExitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return exitOK
+	case cmdError:
+		return e.code
+	}
+	if err == errHelp {
+		return exitOK
+	}
+	return exitError
+}
+
+type command struct {
+	Name        string
+	Summary     string
+	Help        string
+	Subcommands []string // one of which must follow the command name
+	NoConfig    bool     // command doesn't need -e/-f
+	Flags       func(fs *flag.FlagSet, f *flags)
+	Run         func(f flags) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			Name:    "deploy",
+			Summary: "Check images exist and deploy to Marathon (default)",
+			Help: "Renders the Marathon file, checks all Docker images exist, shows\n" +
+				"the changes and deploys the group to Marathon.\n\n" +
+				"Exit codes: 0 deployed, 1 error, 2 usage, 3 cancelled,\n" +
+				"4 deployment failed (with -marathon.wait)",
+			Flags: func(fs *flag.FlagSet, f *flags) {
+				flagsWait(fs, f)
+				fs.BoolVar(&f.marathonForce, "marathon.force", false, "Add the ?force=true to the Marathon request")
+				fs.BoolVar(&f.rollback, "rollback-on-failure", false, "Roll back to the previous group version if the Marathon deployment fails (implies -marathon.wait)")
+				fs.BoolVar(&f.diff, "diff", true, "Show changes to the Marathon group before deploying")
+			},
+			Run: cmdDeploy,
+		},
+		{
+			Name:    "render",
+			Summary: "Print the Marathon JSON without contacting any service",
+			Help: "Renders the Marathon file with the image references substituted.\n" +
+				"Images are not checked (unless pinned by digest), and git is not\n" +
+				"run if -tag is given.\n\n" +
+				"Exit codes: 0 rendered, 1 error, 2 usage",
+			Flags: func(fs *flag.FlagSet, f *flags) {
+				flagsTag(fs, f)
+				fs.StringVar(&f.outputFormat, "o", "json", "Output format (json or yaml)")
+				fs.StringVar(&f.outputFile, "out", "", "Write to this file instead of stdout")
+			},
+			Run: cmdRender,
+		},
+		{
+			Name:    "validate",
+			Summary: "Validate the config and Marathon file",
+			Help: "Loads the config, renders and validates the Marathon file without\n" +
+				"contacting any service.\n\n" +
+				"Exit codes: 0 valid, 1 invalid, 2 usage",
+			Flags: flagsTag,
+			Run:   cmdValidate,
+		},
+		{
+			Name:    "diff",
+			Summary: "Show the changes a deploy would make to the Marathon group",
+			Help:    "Exit codes: 0 diff shown, 1 error, 2 usage",
+			Run:     cmdDiff,
+		},
+		{
+			Name:    "status",
+			Summary: "Show the Marathon group's deployments and app health",
+			Help:    "Exit codes: 0 all apps healthy, 1 error, 2 usage, 4 apps unhealthy or deploying",
+			Run:     cmdStatus,
+		},
+		{
+			Name:    "rollback",
+			Summary: "Roll the Marathon group back to a previous version",
+			Help: "Rolls back to the version before the current one, or the version\n" +
+				"given with -version (see the history command).\n\n" +
+				"Exit codes: 0 rolled back, 1 error, 2 usage, 3 cancelled,\n" +
+				"4 rollback failed (with -marathon.wait)",
+			Flags: func(fs *flag.FlagSet, f *flags) {
+				flagsWait(fs, f)
+				fs.StringVar(&f.rollbackVersion, "version", "", "Group version to roll back to (default: the previous version)")
+			},
+			Run: cmdRollback,
+		},
+		{
+			Name:    "images",
+			Summary: "List the Docker images and check they exist",
+			Help:    "Exit codes: 0 all images found, 1 error, 2 usage",
+			Flags: func(fs *flag.FlagSet, f *flags) {
+				fs.BoolVar(&f.checkImages, "check", true, "Check images exist in their registry")
+			},
+			Run: cmdImages,
+		},
+		{
+			Name:    "history",
+			Summary: "List previous versions of the Marathon group",
+			Help:    "Exit codes: 0 success, 1 error, 2 usage",
+			Flags: func(fs *flag.FlagSet, f *flags) {
+				fs.IntVar(&f.historyLimit, "n", 10, "Number of versions to show (0 for all)")
+			},
+			Run: cmdHistory,
+		},
+		{
+			Name:    "config",
+			Summary: "Show the config of an environment",
+			Help: "show: prints the config of the environment as YAML, merged with\n" +
+				"the environments it extends and with ${...} references expanded.\n" +
+				"Secrets are hidden.\n\n" +
+				"Exit codes: 0 success, 1 error, 2 usage",
+			Subcommands: []string{"show"},
+			Run:         cmdConfig,
+		},
+		{
+			Name:     "help",
+			Summary:  "Show help for a command",
+			NoConfig: true,
+			Run:      cmdHelp,
+		},
+	}
+}
+
+// commandFind returns the command with the given name
+func commandFind(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// commandsUsage prints the list of commands
+func commandsUsage() {
+	fmt.Fprintf(stderr, "Usage: cfdeploy <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(stderr, "  %-10s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(stderr, "\nRun 'cfdeploy help <command>' for the flags of a command.\n")
+	fmt.Fprintf(stderr, "'cfdeploy -e ENV ...' is an alias for 'cfdeploy deploy -e ENV ...'.\n")
+}
+
+// commandUsage prints the help text and flags of a command
+func commandUsage(cmd command, fs *flag.FlagSet) {
+	name := cmd.Name
+	if len(cmd.Subcommands) > 0 {
+		name += " " + strings.Join(cmd.Subcommands, "|")
+	}
+	fmt.Fprintf(stderr, "Usage: cfdeploy %s [flags]\n\n%s\n", name, cmd.Summary)
+	if cmd.Help != "" {
+		fmt.Fprintf(stderr, "\n%s\n", cmd.Help)
+	}
+	fmt.Fprintf(stderr, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+func cmdHelp(f flags) error {
+	if len(f.args) == 0 {
+		commandsUsage()
+		return nil
+	}
+	var helpFlags flags
+	_, err := helpFlags.parse([]string{f.args[0], "-h"})
+	if err == errHelp {
+		return nil
+	}
+	return err
+}
+
+// cmdLoadConfig reads and parses the config file
+func cmdLoadConfig(f flags) (config, error) {
+	configData, err := ioutil.ReadFile(f.configPath)
+	if err != nil {
+		return config{}, fmt.Errorf("Error reading config file '%s': %s", f.configPath, err)
+	}
+	conf, err := configLoad(configData, f)
+	if err != nil {
+		return config{}, fmt.Errorf("Error parsing config file: %s", err)
+	}
+	redactAddKeys(conf.Redact.Keys)
+	redactHeaders(conf.Marathon.Headers)
+	return conf, nil
+}
+
+// cmdLoadImages compiles the environment's images (and vars & metadata) into
+// the template vars, checking the images exist in their registry (and getting
+// their digest) if check is true
+func cmdLoadImages(f flags, conf config, check bool) (fileVars, error) {
+	images, err := dockerImageList(conf, f.env)
+	if err != nil {
+		return fileVars{}, fmt.Errorf("Unable to verify docker images exists: %s", err)
+	}
+	// Check images (images pinned by digest must always be resolved)
+	checkImages := map[string]dockerImage{}
+	for key, image := range images {
+		if check || image.PinDigest {
+			checkImages[key] = image
+		}
+	}
+	digests, err := dockerCheckImages(checkImages, f.concurrency)
+	if err != nil {
+		return fileVars{}, fmt.Errorf("Unable to verify docker images exists: %s", err)
+	}
+	return cmdImageVars(f, conf, images, digests), nil
+}
+
+// cmdImageVars builds the template vars of images & their digests
+func cmdImageVars(f flags, conf config, images map[string]dockerImage, digests map[string]string) fileVars {
+	// Every image has a digest entry (empty if it wasn't checked), so only
+	// unknown images are template errors
+	vars := fileVars{
+		Images:      map[string]string{},
+		Digests:     map[string]string{},
+		Vars:        conf.Environments[f.env].Vars,
+		Environment: f.env,
+		User:        fileUser(),
+		Time:        time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, image := range images {
+		image.Digest = digests[key]
+		vars.Images[key] = image.Reference()
+		vars.Digests[key] = digests[key]
+	}
+	return vars
+}
+
+// cmdMarathon is the loaded config & rendered Marathon group
+type cmdMarathon struct {
+	conf       config
+	vars       fileVars
+	group      marathonGroup
+	jsonConfig []byte
+}
+
+// cmdLoadMarathon loads the config & renders the environment's Marathon
+// group. The Docker images are checked if check is true.
+func cmdLoadMarathon(f flags, check bool) (m cmdMarathon, err error) {
+	m.conf, err = cmdLoadConfig(f)
+	if err != nil {
+		return cmdMarathon{}, err
+	}
+	if m.conf.Marathon.Host == "" {
+		return cmdMarathon{}, fmt.Errorf("Deploy target unknown. Valid options: Marathon")
+	}
+	m.vars, err = cmdLoadImages(f, m.conf, check)
+	if err != nil {
+		return cmdMarathon{}, err
+	}
+	m.group, m.jsonConfig, err = marathonPrepare(f, m.conf, m.vars)
+	if err != nil {
+		return cmdMarathon{}, fmt.Errorf("Error loading Marathon file: %s", err)
+	}
+	err = marathonAuthenticate(&m.conf)
+	if err != nil {
+		return cmdMarathon{}, fmt.Errorf("Error authenticating with Marathon: %s", err)
+	}
+	return m, nil
+}
+
+// cmdPlaceholderTag is the image tag used when only the group ID is needed
+const cmdPlaceholderTag = "cfdeploy-placeholder"
+
+// cmdLoadGroupID loads the config & finds the environment's Marathon group
+// ID, for commands which only need the group (e.g. rollback). Tag templates
+// aren't rendered, images aren't checked and metadata labels aren't added,
+// so these commands work outside a git checkout or with a dirty tree.
+func cmdLoadGroupID(f flags) (config, string, error) {
+	f.imageTag = cmdPlaceholderTag
+	conf, err := cmdLoadConfig(f)
+	if err != nil {
+		return config{}, "", err
+	}
+	if conf.Marathon.Host == "" {
+		return config{}, "", fmt.Errorf("Deploy target unknown. Valid options: Marathon")
+	}
+	images, err := dockerImageList(conf, f.env)
+	if err != nil {
+		return config{}, "", fmt.Errorf("Error loading images: %s", err)
+	}
+	conf.Metadata.Labels = false
+	group, _, err := marathonPrepare(f, conf, cmdImageVars(f, conf, images, nil))
+	if err != nil {
+		return config{}, "", fmt.Errorf("Error loading Marathon file: %s", err)
+	}
+	err = marathonAuthenticate(&conf)
+	if err != nil {
+		return config{}, "", fmt.Errorf("Error authenticating with Marathon: %s", err)
+	}
+	return conf, marathonAbsoluteID("/", group.ID), nil
+}
+
+// cmdPrintInfo prints the environment, images & Marathon target
+func cmdPrintInfo(f flags, conf config, vars fileVars) {
+	fmt.Fprintf(stdout, "Environment: %s\n", f.env)
+	fmt.Fprintf(stdout, "Config File: %s (%s)\n", f.configFile, f.configPath)
+	fmt.Fprintf(stdout, "Images:\n")
+	keys := make([]string, 0, len(vars.Images))
+	for key := range vars.Images {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(stdout, "* %s = %s\n", key, vars.Images[key])
+	}
+	fmt.Fprintf(
+		stdout,
+		"Marathon File: %s\n",
+		conf.Environments[f.env].Marathon.File,
+	)
+	fmt.Fprintf(stdout, "Marathon URL: %s\n", marathonURL(conf, f.marathonForce))
+	fmt.Fprintf(stdout, "Marathon Host: %s (%s)\n", conf.Marathon.Host, conf.Marathon.sources["host"])
+	if tls := conf.Marathon.TLS; tls != (configTLS{}) {
+		var settings []string
+		if tls.CAFile != "" {
+			settings = append(settings, "CA "+tls.CAFile)
+		}
+		if tls.CertFile != "" {
+			settings = append(settings, "client certificate "+tls.CertFile)
+		}
+		if tls.ServerName != "" {
+			settings = append(settings, "server name "+tls.ServerName)
+		}
+		if tls.InsecureSkipVerify {
+			settings = append(settings, "INSECURE (certificate not verified)")
+		}
+		fmt.Fprintf(stdout, "Marathon TLS: %s (%s)\n", strings.Join(settings, ", "), conf.Marathon.sources["tls"])
+	}
+	if method := marathonAuthMethod(conf.Marathon.Auth); method != "" {
+		fmt.Fprintf(stdout, "Marathon Auth: %s (%s)\n", method, conf.Marathon.sources["auth"])
+	}
+	if len(conf.Marathon.Headers) > 0 {
+		fmt.Fprintf(stdout, "Marathon Headers:\n")
+		keys = keys[:0]
+		for key := range conf.Marathon.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, value := range conf.Marathon.Headers[key] {
+				if redactKey(key) {
+					value = redactHidden
+				}
+				fmt.Fprintf(stdout, "* %s = %s\n", key, value)
+			}
+		}
+	}
+}
+
+// cmdPrintDiff prints the changes between the deployed & desired group
+func cmdPrintDiff(conf config, group marathonGroup) error {
+	current, exists, err := marathonGroupGet(conf, group.ID)
+	if err != nil {
+		return fmt.Errorf("Error getting Marathon group:\n%s", err)
+	}
+	if !exists {
+		fmt.Fprintf(stdout, "Marathon Changes: group %s does not exist yet\n", group.ID)
+		return nil
+	}
+	diffs, err := marathonDiff(current, group)
+	if err != nil {
+		return fmt.Errorf("Error comparing Marathon group: %s", err)
+	}
+	fmt.Fprintf(stdout, "Marathon Changes:\n%s", marathonDiffString(diffs))
+	return nil
+}
+
+// cmdWatch waits for a deployment if -marathon.wait is set
+func cmdWatch(f flags, groupID string, conf config, result marathonResult) error {
+	if !f.marathonWait {
+		return nil
+	}
+	err := marathonWatch(conf, groupID, result, f.marathonTimeout)
+	if err != nil {
+		return cmdErrorf(exitFailed, "Marathon deployment failed:\n%s", err)
+	}
+	return nil
+}
+
+// cmdConfirm asks the user to confirm (unless -y was given)
+func cmdConfirm(f flags, prompt string) bool {
+	return f.skipPrompt || promptConfirm(prompt)
+}
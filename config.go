@@ -1,69 +1,285 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"reflect"
 	"strings"
-
-	yaml "gopkg.in/yaml.v2"
 )
 
 type config struct {
-	Marathon     configMarathon               `yaml:"marathon"`
-	Image        configImage                  `yaml:"image"`
-	Environments map[string]configEnvironment `yaml:"environments"`
+	Marathon     configMarathon               `yaml:"marathon,omitempty"`
+	Image        configImage                  `yaml:"image,omitempty"`
+	Registries   map[string]configRegistry    `yaml:"registries,omitempty"`
+	Redact       configRedact                 `yaml:"redact,omitempty"`
+	Partials     string                       `yaml:"partials,omitempty"` // directory of Marathon file partials
+	Metadata     configMetadata               `yaml:"metadata,omitempty"`
+	Git          configGit                    `yaml:"git,omitempty"`
+	Environments map[string]configEnvironment `yaml:"environments,omitempty"`
 }
 
 type configMarathon struct {
-	Host    string `yaml:"host"`
-	Headers http.Header
+	Host    string             `yaml:"host,omitempty"`
+	Scheme  string             `yaml:"scheme,omitempty"`
+	TLS     configTLS          `yaml:"tls,omitempty"`
+	Auth    configMarathonAuth `yaml:"auth,omitempty"`
+	Headers http.Header        `yaml:"headers,omitempty"`
+
+	// Where the host, scheme, tls & auth settings came from e.g.
+	// "environments.prod.marathon.host" or "-marathon.host"
+	sources map[string]string
+}
+
+// configMarathonAuth configures how to authenticate with Marathon. At most
+// one of Basic, Token & DCOS can be set. Headers can be added as well e.g.
+// for an auth proxy.
+type configMarathonAuth struct {
+	Basic   *configBasicAuth `yaml:"basic,omitempty"`
+	Token   *configSecret    `yaml:"token,omitempty"`
+	DCOS    *configDCOSAuth  `yaml:"dcos,omitempty"`
+	Headers *configSecret    `yaml:"headers,omitempty"`
+}
+
+type configBasicAuth struct {
+	Username string       `yaml:"username,omitempty"`
+	Password configSecret `yaml:"password,omitempty"`
+}
+
+// configDCOSAuth is a DC/OS service account, which logs in with a JWT
+// signed by its private key
+type configDCOSAuth struct {
+	UID        string       `yaml:"uid,omitempty"`
+	PrivateKey configSecret `yaml:"privateKey,omitempty"`
+	LoginURL   string       `yaml:"loginURL,omitempty"` // defaults to the Marathon host
+}
+
+// configSecret is a sensitive value, which can be given in the config,
+// or read from an environment variable, file or command (so it needn't be
+// committed) e.g. "password: hunter2", "password: {env: PASSWORD}",
+// "password: {file: password.txt}" or "password: ${exec:pass marathon}".
+// Secrets are only read (and ${...} references expanded) when used.
+type configSecret struct {
+	Value string `yaml:"value,omitempty"`
+	Env   string `yaml:"env,omitempty"`
+	File  string `yaml:"file,omitempty"`
+	Exec  string `yaml:"exec,omitempty"`
+	dir   string // config directory
+}
+
+// UnmarshalYAML allows a secret to be given as a plain string
+func (s *configSecret) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*s = configSecret{Value: value}
+		return nil
+	}
+	type plain configSecret
+	return unmarshal((*plain)(s))
+}
+
+// MarshalYAML shows where a secret is read from, but not its value (unless
+// it is a ${...} reference)
+func (s configSecret) MarshalYAML() (interface{}, error) {
+	if s.Env != "" || s.File != "" || s.Exec != "" {
+		s.Value = ""
+		type plain configSecret
+		return plain(s), nil
+	}
+	if strings.Contains(s.Value, "${") {
+		return s.Value, nil
+	}
+	return redactHidden, nil
+}
+
+// Get returns the value of a secret, which is hidden in any output
+func (s configSecret) Get() (string, error) {
+	var value string
+	var err error
+	switch {
+	case s.Env != "":
+		value, err = configProviderEnv(s.Env, s.dir)
+	case s.File != "":
+		value, err = configProviderFile(s.File, s.dir)
+	case s.Exec != "":
+		value, err = configProviderExec(s.Exec, s.dir)
+	default:
+		value, err = configExpand(s.Value, s.dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	redactAddValue(value)
+	return value, nil
+}
+
+// configGit configures how git is used for image tags
+type configGit struct {
+	// Refuse to render tag templates using git variables if the working
+	// tree has uncommitted changes
+	RequireClean bool `yaml:"requireClean,omitempty"`
+}
+
+// configMetadata configures the deployment metadata added to apps
+type configMetadata struct {
+	// Add cfdeploy.* labels (e.g. the git commit & deploying user) to every
+	// app, so running tasks can be traced back to their deployment
+	Labels bool `yaml:"labels,omitempty"`
+}
+
+// configRedact configures which secrets are hidden in output
+type configRedact struct {
+	// Patterns of env var, label & header names whose values are hidden,
+	// in addition to the defaults e.g. "*_DSN"
+	Keys []string `yaml:"keys,omitempty"`
+}
+
+// configRegistry configures how to connect to a Docker registry, keyed by
+// the image repository (e.g. "registry.example.com:5000")
+type configRegistry struct {
+	Scheme string    `yaml:"scheme,omitempty"`
+	TLS    configTLS `yaml:"tls,omitempty"`
+}
+
+// configTLS configures the TLS connection to a server. Relative file paths
+// are relative to the config file.
+type configTLS struct {
+	CAFile             string `yaml:"caFile,omitempty"`
+	CertFile           string `yaml:"certFile,omitempty"`
+	KeyFile            string `yaml:"keyFile,omitempty"`
+	ServerName         string `yaml:"serverName,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
 }
 
 type configImage struct {
-	Repository  string `yaml:"repository"`
-	Name        string `yaml:"name"`
-	TagTemplate string `yaml:"tagTemplate"`
+	Repository  string   `yaml:"repository,omitempty"`
+	Name        string   `yaml:"name,omitempty"`
+	TagTemplate string   `yaml:"tagTemplate,omitempty"`
+	Digest      *bool    `yaml:"digest,omitempty"`
+	Platforms   []string `yaml:"platforms,omitempty"`
 }
 
 type configEnvironment struct {
-	Marathon struct {
-		File string `yaml:"file"`
-	} `yaml:"marathon"`
-	Images map[string]configImage
+	Extends  string                    `yaml:"extends,omitempty"`
+	Marathon configEnvironmentMarathon `yaml:"marathon,omitempty"`
+	Images   map[string]configImage    `yaml:"images,omitempty"`
+	Vars     map[string]interface{}    `yaml:"vars,omitempty"` // .Vars in the Marathon file
+}
+
+// configEnvironmentMarathon is the Marathon file of an environment, and
+// any Marathon settings which override the top level ones
+type configEnvironmentMarathon struct {
+	configMarathon `yaml:",inline"`
+	File           string `yaml:"file,omitempty"`
 }
 
 func configLoad(fileData []byte, flags flags) (config, error) {
 
 	// Parse file YAML
 	var c config
-	err := yaml.Unmarshal(fileData, &c)
+	err := yamlUnmarshalStrict(flags.configFile, fileData, &c)
 	if err != nil {
 		return config{}, err
 	}
 
-	// Check environment exists
+	// Check environment exists, and merge it with any it extends
 	if _, ok := c.Environments[flags.env]; !ok {
 		return config{}, fmt.Errorf("Environment %s not found in config", flags.env)
 	}
+	env, err := configResolveEnvironment(c.Environments, flags.env)
+	if err != nil {
+		return config{}, err
+	}
+	if env.Marathon.File == "" {
+		return config{}, fmt.Errorf("environments.%s.marathon.file must be set", flags.env)
+	}
+
+	// Expand ${...} references. Only the environment being used is
+	// expanded, so the secrets of other environments aren't needed.
+	for _, section := range []struct {
+		field string
+		value interface{}
+	}{
+		{"marathon", &c.Marathon},
+		{"image", &c.Image},
+		{"registries", &c.Registries},
+		{"redact", &c.Redact},
+		{"environments." + flags.env, &env},
+	} {
+		err = configExpandValue(reflect.ValueOf(section.value).Elem(), section.field, flags.configDir)
+		if err != nil {
+			return config{}, err
+		}
+	}
+	env.Vars, err = configLoadVars(env.Vars, flags)
+	if err != nil {
+		return config{}, err
+	}
+	c.Environments[flags.env] = env
+
+	// Override marathon settings with the environment's
+	configMergeMarathon(&c.Marathon, env.Marathon.configMarathon, flags.env)
+
+	// Partials are relative to the config file
+	if c.Partials == "" {
+		c.Partials = filePartialsDir
+	}
+	if !filepath.IsAbs(c.Partials) {
+		c.Partials = filepath.Join(flags.configDir, c.Partials)
+	}
+	// Every file in the partials directory is parsed, so it can't be the
+	// config directory (which has deploy.yaml & the Marathon files)
+	if rel, err := filepath.Rel(c.Partials, filepath.Clean(flags.configDir)); err == nil && !strings.HasPrefix(rel, "..") {
+		return config{}, fmt.Errorf("partials must be a subdirectory of the config directory, or outside it")
+	}
+
+	// Check schemes & TLS settings
+	err = configCheckConnection("marathon", &c.Marathon.Scheme, &c.Marathon.TLS, flags.configDir)
+	if err != nil {
+		return config{}, err
+	}
+	err = configCheckMarathonAuth(&c.Marathon.Auth, flags.configDir)
+	if err != nil {
+		return config{}, err
+	}
+	for host, registry := range c.Registries {
+		err = configCheckConnection("registries."+host, &registry.Scheme, &registry.TLS, flags.configDir)
+		if err != nil {
+			return config{}, err
+		}
+		c.Registries[host] = registry
+	}
 
 	// Override marathon host if provided
 	if flags.marathonHost != "" {
 		c.Marathon.Host = flags.marathonHost
+		c.Marathon.sources["host"] = "-marathon.host"
 	}
 
-	// Parse marathon headers if provided
-	if flags.marathonCurlOpts != "" {
-		c.Marathon.Headers = http.Header{}
-		curlOpts := strings.Split(flags.marathonCurlOpts, "-H")
-		for _, curlOpt := range curlOpts {
-			curlOpt = strings.TrimSpace(strings.Replace(curlOpt, "\"", "", 2))
-			if curlOpt == "" {
-				continue
-			}
-			curlOptSplit := strings.Split(curlOpt, ": ")
-			if len(curlOptSplit) == 2 {
-				c.Marathon.Headers.Add(curlOptSplit[0], curlOptSplit[1])
+	// Override image tags if provided, so git isn't required
+	if flags.imageTag != "" {
+		c.Image.TagTemplate = flags.imageTag
+		for envKey, env := range c.Environments {
+			for imageKey, image := range env.Images {
+				image.TagTemplate = flags.imageTag
+				env.Images[imageKey] = image
 			}
+			c.Environments[envKey] = env
+		}
+	}
+
+	// Add marathon headers if provided
+	if flags.marathonCurlOpts != "" {
+		headers, err := configParseCurlOpts(flags.marathonCurlOpts)
+		if err != nil {
+			return config{}, err
+		}
+		if c.Marathon.Headers == nil {
+			c.Marathon.Headers = http.Header{}
+		}
+		for key, values := range headers {
+			c.Marathon.Headers[key] = values
 		}
 	}
 
@@ -71,3 +287,284 @@ func configLoad(fileData []byte, flags flags) (config, error) {
 	return c, nil
 
 }
+
+// configMergeMarathon overrides the top level Marathon settings with those
+// of an environment, recording where each setting came from
+func configMergeMarathon(m *configMarathon, env configMarathon, envName string) {
+	m.sources = map[string]string{}
+	for _, key := range []string{"host", "scheme", "tls", "auth"} {
+		m.sources[key] = "marathon." + key
+	}
+	for _, key := range configOverrideMarathon(m, env) {
+		source := env.sources[key]
+		if source == "" {
+			source = "environments." + envName + ".marathon." + key
+		}
+		m.sources[key] = source
+	}
+}
+
+// configOverrideMarathon overrides the Marathon settings in m with those set
+// in o. The host & scheme override individually, the tls settings & auth
+// method (basic, token or dcos) are replaced as a whole, and headers
+// override by name. The overridden keys (of host, scheme, tls & auth) are
+// returned.
+func configOverrideMarathon(m *configMarathon, o configMarathon) []string {
+	var keys []string
+	if o.Host != "" {
+		m.Host = o.Host
+		keys = append(keys, "host")
+	}
+	if o.Scheme != "" {
+		m.Scheme = o.Scheme
+		keys = append(keys, "scheme")
+	}
+	if o.TLS != (configTLS{}) {
+		m.TLS = o.TLS
+		keys = append(keys, "tls")
+	}
+	if o.Auth.Basic != nil || o.Auth.Token != nil || o.Auth.DCOS != nil {
+		m.Auth.Basic, m.Auth.Token, m.Auth.DCOS = o.Auth.Basic, o.Auth.Token, o.Auth.DCOS
+		keys = append(keys, "auth")
+	}
+	if o.Auth.Headers != nil {
+		m.Auth.Headers = o.Auth.Headers
+	}
+	if len(o.Headers) > 0 && m.Headers == nil {
+		m.Headers = http.Header{}
+	}
+	for key, values := range o.Headers {
+		m.Headers[key] = values
+	}
+	return keys
+}
+
+// configResolveEnvironment merges an environment with the environments it
+// extends (recursively). Settings of an environment override those of the
+// environment it extends: images are merged by key and field, vars as in
+// configMergeVars, and the Marathon settings as in configOverrideMarathon.
+func configResolveEnvironment(environments map[string]configEnvironment, name string) (configEnvironment, error) {
+	// Find the chain of environments e.g. [prod, staging, base]
+	chain := []string{name}
+	for env := environments[name]; env.Extends != ""; env = environments[env.Extends] {
+		for _, n := range chain {
+			if n == env.Extends {
+				return configEnvironment{}, fmt.Errorf(
+					"Cycle in environments extended by %s: %s -> %s",
+					name,
+					strings.Join(chain, " -> "),
+					env.Extends,
+				)
+			}
+		}
+		if _, ok := environments[env.Extends]; !ok {
+			return configEnvironment{}, fmt.Errorf(
+				"Environment %s extends unknown environment %s",
+				chain[len(chain)-1],
+				env.Extends,
+			)
+		}
+		chain = append(chain, env.Extends)
+	}
+
+	// Merge from the base environment up
+	merged := configEnvironment{Extends: environments[name].Extends}
+	for i := len(chain) - 1; i >= 0; i-- {
+		env := environments[chain[i]]
+		if env.Marathon.File != "" {
+			merged.Marathon.File = env.Marathon.File
+		}
+		for _, key := range configOverrideMarathon(&merged.Marathon.configMarathon, env.Marathon.configMarathon) {
+			if merged.Marathon.sources == nil {
+				merged.Marathon.sources = map[string]string{}
+			}
+			merged.Marathon.sources[key] = "environments." + chain[i] + ".marathon." + key
+		}
+		if len(env.Images) > 0 && merged.Images == nil {
+			merged.Images = map[string]configImage{}
+		}
+		for key, image := range env.Images {
+			merged.Images[key] = configMergeImage(merged.Images[key], image)
+		}
+		merged.Vars = configMergeVars(merged.Vars, env.Vars)
+	}
+	return merged, nil
+}
+
+// configMergeImage overrides the fields of an image set in o
+func configMergeImage(image, o configImage) configImage {
+	if o.Repository != "" {
+		image.Repository = o.Repository
+	}
+	if o.Name != "" {
+		image.Name = o.Name
+	}
+	if o.TagTemplate != "" {
+		image.TagTemplate = o.TagTemplate
+	}
+	if o.Digest != nil {
+		image.Digest = o.Digest
+	}
+	if len(o.Platforms) > 0 {
+		image.Platforms = o.Platforms
+	}
+	return image
+}
+
+// configCheckConnection validates the scheme & TLS settings of a server,
+// defaulting the scheme to https and making TLS file paths absolute
+func configCheckConnection(key string, scheme *string, t *configTLS, configDir string) error {
+	if *scheme == "" {
+		*scheme = "https"
+	}
+	if *scheme != "http" && *scheme != "https" {
+		return fmt.Errorf("%s.scheme must be http or https. Found: %s", key, *scheme)
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("%s.tls.certFile and %s.tls.keyFile must be set together", key, key)
+	}
+	for _, path := range []*string{&t.CAFile, &t.CertFile, &t.KeyFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(configDir, *path)
+		}
+	}
+	return nil
+}
+
+// configCheckMarathonAuth validates the Marathon auth settings, making file
+// paths absolute
+func configCheckMarathonAuth(auth *configMarathonAuth, configDir string) error {
+	var methods []string
+	if auth.Basic != nil {
+		methods = append(methods, "basic")
+		if auth.Basic.Username == "" {
+			return fmt.Errorf("marathon.auth.basic.username is required")
+		}
+		configSecretDir(&auth.Basic.Password, configDir)
+	}
+	if auth.Token != nil {
+		methods = append(methods, "token")
+		configSecretDir(auth.Token, configDir)
+	}
+	if auth.DCOS != nil {
+		methods = append(methods, "dcos")
+		if auth.DCOS.UID == "" {
+			return fmt.Errorf("marathon.auth.dcos.uid is required")
+		}
+		configSecretDir(&auth.DCOS.PrivateKey, configDir)
+	}
+	if len(methods) > 1 {
+		return fmt.Errorf(
+			"Only one of marathon.auth.%s can be set",
+			strings.Join(methods, ", marathon.auth."),
+		)
+	}
+	if auth.Headers != nil {
+		configSecretDir(auth.Headers, configDir)
+	}
+	return nil
+}
+
+// configSecretDir sets the directory that the paths of a secret (e.g. its
+// file) are relative to
+func configSecretDir(s *configSecret, configDir string) {
+	s.dir = configDir
+}
+
+// configParseCurlOpts parses the headers from cURL options, which are split
+// into words like a shell would e.g. -H "Cookie: a=b" -H 'X-Token: "c"'.
+// Options other than headers are ignored.
+func configParseCurlOpts(curlOpts string) (http.Header, error) {
+	words, err := configSplitWords(curlOpts)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing -marathon.curlopts: %s", err)
+	}
+	headers := http.Header{}
+	for i := 0; i < len(words); i++ {
+		var header string
+		switch {
+		case words[i] == "-H" || words[i] == "--header":
+			if i+1 == len(words) {
+				return nil, fmt.Errorf("Error parsing -marathon.curlopts: %s requires a header", words[i])
+			}
+			i++
+			header = words[i]
+		case strings.HasPrefix(words[i], "-H"):
+			header = words[i][2:]
+		default:
+			continue
+		}
+		key, value, err := configParseHeader(header)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing -marathon.curlopts: %s", err)
+		}
+		headers.Add(key, value)
+	}
+	return headers, nil
+}
+
+// configParseHeader splits a "Name: value" header. Only the first colon
+// separates the name, so values may contain colons.
+func configParseHeader(header string) (key, value string, err error) {
+	i := strings.Index(header, ":")
+	if i < 1 {
+		return "", "", fmt.Errorf("Invalid header '%s'. Expected 'Name: value'", header)
+	}
+	key = strings.TrimSpace(header[:i])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", fmt.Errorf("Invalid header name '%s'", key)
+	}
+	return key, strings.TrimSpace(header[i+1:]), nil
+}
+
+// configSplitWords splits a string into words like a shell, supporting
+// single & double quotes and backslash escapes
+func configSplitWords(s string) ([]string, error) {
+	var words []string
+	var word bytes.Buffer
+	inWord := false
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\\' && quote != '\'':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("Trailing backslash")
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("Unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// configProvider resolves a ${provider:arg} reference in the config.
+// configDir is the directory of the config file.
+type configProvider func(arg, configDir string) (string, error)
+
+// configProviders are the sources of ${provider:arg} references. Values
+// read from a provider other than env are secrets, so are redacted.
+var configProviders = map[string]configProvider{
+	"env":  configProviderEnv,
+	"file": configProviderFile,
+	"exec": configProviderExec,
+}
+
+// configVarName matches the name of an environment variable
+var configVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// configExpand replaces the ${...} references in s:
+//
+//	${VAR}              the environment variable VAR, which must be set
+//	${VAR:-default}     VAR, or default if VAR is unset or empty
+//	${env:VAR}          the same as ${VAR}
+//	${file:path}        the contents of a file (relative to the config)
+//	${exec:command}     the output of a shell command
+//
+// Defaults can be given for any reference. $${ is replaced by a literal ${.
+func configExpand(s, configDir string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		// Escaped
+		if i > 0 && s[i-1] == '$' {
+			buf.WriteString(s[:i])
+			buf.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		buf.WriteString(s[:i])
+		end := strings.Index(s[i:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated reference in '%s'", s[i:])
+		}
+		value, err := configResolve(s[i+2:i+end], configDir)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// configResolve resolves the expression inside a ${...} reference
+func configResolve(expr, configDir string) (string, error) {
+	// Default value
+	var def string
+	hasDefault := false
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		expr, def, hasDefault = expr[:i], expr[i+2:], true
+	}
+	// Provider, defaulting to env
+	name, arg := "env", expr
+	if i := strings.Index(expr, ":"); i >= 0 {
+		name, arg = expr[:i], expr[i+1:]
+	}
+	provider, ok := configProviders[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown provider '%s' in ${%s}", name, expr)
+	}
+	if name == "env" && !configVarName.MatchString(arg) {
+		return "", fmt.Errorf("Invalid environment variable name in ${%s}", expr)
+	}
+	// The default is used for unset env vars & empty values, but file &
+	// exec errors (e.g. a failed login) are always returned
+	value, err := provider(arg, configDir)
+	if err != nil {
+		if name == "env" && hasDefault {
+			return def, nil
+		}
+		return "", err
+	}
+	if value == "" && hasDefault {
+		return def, nil
+	}
+	if name != "env" || redactKey(arg) {
+		redactAddValue(value)
+	}
+	return value, nil
+}
+
+// configProviderEnv reads an environment variable, which must be set
+func configProviderEnv(name, configDir string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("Environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// configProviderFile reads a file, without any trailing newline
+func configProviderFile(path, configDir string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(configDir, path)
+	}
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// configProviderExec runs a shell command (in the config directory) and
+// returns its output, without any trailing newline e.g.
+// ${exec:vault kv get -field=token secret/marathon}
+func configProviderExec(command, configDir string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command) // #nosec G204
+	cmd.Dir = configDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf(
+			"Error running '%s': %s",
+			command,
+			strings.TrimSpace(err.Error()+" "+stderr.String()),
+		)
+	}
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+// configExpandValue expands every string in v (a pointer to a config
+// struct), naming the field in errors e.g. "marathon.host". Secrets are
+// skipped, as they are only expanded when used.
+func configExpandValue(v reflect.Value, field, configDir string) error {
+	switch v.Kind() {
+	case reflect.String:
+		expanded, err := configExpand(v.String(), configDir)
+		if err != nil {
+			return fmt.Errorf("%s: %s", field, err)
+		}
+		v.SetString(expanded)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return configExpandValue(v.Elem(), field, configDir)
+		}
+	case reflect.Interface:
+		// e.g. vars. The value isn't addressable, so expand a copy
+		if !v.IsNil() {
+			value := reflect.New(v.Elem().Type()).Elem()
+			value.Set(v.Elem())
+			err := configExpandValue(value, field, configDir)
+			if err != nil {
+				return err
+			}
+			v.Set(value)
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(configSecret{}) {
+			return nil
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			tag := strings.Split(f.Tag.Get("yaml"), ",")
+			name := configJoinField(field, tag[0])
+			if tag[0] == "" {
+				name = configJoinField(field, strings.ToLower(f.Name))
+			}
+			if len(tag) > 1 && tag[1] == "inline" {
+				name = field
+			}
+			err := configExpandValue(v.Field(i), name, configDir)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := configExpandValue(v.Index(i), fmt.Sprintf("%s[%d]", field, i), configDir)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values aren't addressable, so expand a copy & replace them
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			err := configExpandValue(value, configJoinField(field, fmt.Sprint(key.Interface())), configDir)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	}
+	return nil
+}
+
+// configJoinField appends a key to a field path
+func configJoinField(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigExpand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "token.txt"), []byte("file-token\n"), 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error writing file: %s", err)
+	}
+	defer os.Unsetenv("CFDEPLOY_TEST_HOST")
+	os.Setenv("CFDEPLOY_TEST_HOST", "marathon.example.com") // #nosec G104
+	defer os.Unsetenv("CFDEPLOY_TEST_EMPTY")
+	os.Setenv("CFDEPLOY_TEST_EMPTY", "") // #nosec G104
+
+	tests := []struct {
+		value  string
+		expect string
+		err    string
+	}{
+		{value: "no references", expect: "no references"},
+		{value: "${CFDEPLOY_TEST_HOST}:8080", expect: "marathon.example.com:8080"},
+		{value: "${env:CFDEPLOY_TEST_HOST}", expect: "marathon.example.com"},
+		{value: "${CFDEPLOY_TEST_MISSING:-localhost}", expect: "localhost"},
+		{value: "${CFDEPLOY_TEST_EMPTY:-localhost}", expect: "localhost"},
+		{value: "${CFDEPLOY_TEST_EMPTY}", expect: ""},
+		{value: "$${CFDEPLOY_TEST_HOST} $5", expect: "${CFDEPLOY_TEST_HOST} $5"},
+		{value: "Bearer ${file:token.txt}", expect: "Bearer file-token"},
+		{value: "${exec:echo exec-token; pwd}", expect: "exec-token\n" + dir},
+		{value: "${CFDEPLOY_TEST_MISSING}", err: "Environment variable CFDEPLOY_TEST_MISSING is not set"},
+		{value: "${vault:secret}", err: "Unknown provider 'vault' in ${vault:secret}"},
+		{value: "${NOT A VAR}", err: "Invalid environment variable name in ${NOT A VAR}"},
+		{value: "${CFDEPLOY_TEST_HOST", err: "Unterminated reference in '${CFDEPLOY_TEST_HOST'"},
+		{value: "${exec:exit 3}", err: "Error running 'exit 3': exit status 3"},
+		// Defaults are only used for unset & empty values, not errors
+		{value: "${exec:true:-exec-default}", expect: "exec-default"},
+		{value: "${file:token.txt:-file-default}", expect: "file-token"},
+		{value: "${exec:exit 1:-x}", err: "Error running 'exit 1': exit status 1"},
+		{value: "${file:missing.txt:-x}", err: "open " + filepath.Join(dir, "missing.txt") + ": no such file or directory"},
+	}
+	for i, test := range tests {
+		got, err := configExpand(test.value, dir)
+		if err != nil && test.err == "" {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err != nil && err.Error() != test.err {
+			t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.err, err)
+		} else if got != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+func TestConfigLoadExpand(t *testing.T) {
+	defer os.Unsetenv("CFDEPLOY_TEST_REPO")
+	os.Setenv("CFDEPLOY_TEST_REPO", "registry.example.com") // #nosec G104
+
+	data := `
+marathon:
+  host: ${CFDEPLOY_TEST_MARATHON:-marathon.example.com}
+  auth:
+    token: ${CFDEPLOY_TEST_TOKEN}
+  headers:
+    X-Team: ["deploy-${CFDEPLOY_TEST_REPO}"]
+image:
+  repository: ${CFDEPLOY_TEST_REPO}
+environments:
+  prod:
+    marathon: {file: prod.yaml}
+    images:
+      svc: {name: "svc-${CFDEPLOY_TEST_MISSING}"}
+  staging:
+    marathon: {file: staging.yaml}
+    images:
+      svc: {name: "svc-${CFDEPLOY_TEST_REPO}"}
+`
+	// Only the environment used is expanded, and secrets aren't expanded
+	// until used
+	c, err := configLoad([]byte(data), flags{env: "staging"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c.Marathon.Host != "marathon.example.com" {
+		t.Errorf("Expected marathon.host 'marathon.example.com', got '%s'", c.Marathon.Host)
+	}
+	if got := c.Marathon.Headers.Get("X-Team"); got != "deploy-registry.example.com" {
+		t.Errorf("Expected X-Team header 'deploy-registry.example.com', got '%s'", got)
+	}
+	if c.Image.Repository != "registry.example.com" {
+		t.Errorf("Expected image.repository 'registry.example.com', got '%s'", c.Image.Repository)
+	}
+	if got := c.Environments["staging"].Images["svc"].Name; got != "svc-registry.example.com" {
+		t.Errorf("Expected image name 'svc-registry.example.com', got '%s'", got)
+	}
+	_, err = c.Marathon.Auth.Token.Get()
+	if err == nil || err.Error() != "Environment variable CFDEPLOY_TEST_TOKEN is not set" {
+		t.Errorf("Expected error getting token, got: %v", err)
+	}
+
+	// Errors name the field
+	_, err = configLoad([]byte(data), flags{env: "prod"})
+	expect := "environments.prod.images.svc.name: Environment variable CFDEPLOY_TEST_MISSING is not set"
+	if err == nil || err.Error() != expect {
+		t.Errorf("Expected error '%s', got: %v", expect, err)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -79,6 +82,64 @@ func TestConfigLoad(t *testing.T) {
 				"OauthExpires": "1501617700",
 			},
 		},
+		// Header values containing colons & quotes
+		{
+			Data: ConfigExample,
+			Flags: flags{
+				env:              "prod",
+				marathonCurlOpts: `-H 'Cookie: a="b:c"' --header "X-Url: https://example.com" -HX-Empty: -k`,
+			},
+			ExpectMarathonHost: "www.example.com",
+			ExpectMarathonHeaders: map[string]string{
+				"Cookie":  `a="b:c"`,
+				"X-Url":   "https://example.com",
+				"X-Empty": "",
+			},
+		},
+		{
+			Data: ConfigExample,
+			Flags: flags{
+				env:              "prod",
+				marathonCurlOpts: `-H "OauthEmail: no-reply@cloudflare.com`,
+			},
+			ExpectError: "Error parsing -marathon.curlopts: Unterminated quote",
+		},
+		{
+			Data: ConfigExample,
+			Flags: flags{
+				env:              "prod",
+				marathonCurlOpts: `-H OauthEmail`,
+			},
+			ExpectError: "Error parsing -marathon.curlopts: Invalid header 'OauthEmail'. Expected 'Name: value'",
+		},
+		// Only one auth method
+		{
+			Data:        "marathon: {auth: {token: abc, basic: {username: a, password: b}}}\nenvironments: {prod: {marathon: {file: prod.yaml}}}",
+			Flags:       flags{env: "prod"},
+			ExpectError: "Only one of marathon.auth.basic, marathon.auth.token can be set",
+		},
+		// Unknown fields, with their position & a suggestion
+		{
+			Data:        "image:\n  tagTemplte: latest\nenvironments: {prod: {marathon: {file: prod.yaml}}}",
+			Flags:       flags{env: "prod", configFile: "deploy.yaml"},
+			ExpectError: "deploy.yaml:2:3: unknown field tagTemplte (did you mean tagTemplate?)",
+		},
+		{
+			Data:        "envirnoments: {prod: {}}\nmarathon: {host: a, port: 80}",
+			Flags:       flags{env: "prod", configFile: "deploy.yaml"},
+			ExpectError: "deploy.yaml:1:1: unknown field envirnoments (did you mean environments?)\ndeploy.yaml:2:21: unknown field port",
+		},
+		{
+			Data:        "environments: {prod: {marathon: {file: prod.yaml}, images: {svc: {digest: maybe}}}}",
+			Flags:       flags{env: "prod", configFile: "deploy.yaml"},
+			ExpectError: "deploy.yaml:1:75: cannot unmarshal !!str `maybe` into bool",
+		},
+		// The environment being used needs a Marathon file
+		{
+			Data:        "environments: {prod: {}, staging: {marathon: {file: staging.yaml}}}",
+			Flags:       flags{env: "prod"},
+			ExpectError: "environments.prod.marathon.file must be set",
+		},
 	}
 
 	for i, test := range tests {
@@ -131,3 +192,401 @@ func TestConfigLoad(t *testing.T) {
 
 	}
 }
+
+func TestConfigLoadConnection(t *testing.T) {
+	tests := []struct {
+		data     string
+		marathon configMarathon
+		registry configRegistry
+		err      string
+	}{
+		// Defaults
+		{
+			data:     "environments: {prod: {marathon: {file: prod.yaml}}}",
+			marathon: configMarathon{Scheme: "https"},
+		},
+		// Relative paths are relative to the config file
+		{
+			data: `
+marathon:
+  host: localhost:8080
+  scheme: http
+  tls: {caFile: ca.pem, certFile: /etc/ssl/client.pem, keyFile: client-key.pem, serverName: marathon}
+registries:
+  registry.example.com: {tls: {caFile: ca.pem, insecureSkipVerify: true}}
+environments: {prod: {marathon: {file: prod.yaml}}}`,
+			marathon: configMarathon{Host: "localhost:8080", Scheme: "http", TLS: configTLS{
+				CAFile:     "/deploy/ca.pem",
+				CertFile:   "/etc/ssl/client.pem",
+				KeyFile:    "/deploy/client-key.pem",
+				ServerName: "marathon",
+			}},
+			registry: configRegistry{Scheme: "https", TLS: configTLS{CAFile: "/deploy/ca.pem", InsecureSkipVerify: true}},
+		},
+		{
+			data: "marathon: {scheme: ftp}\nenvironments: {prod: {marathon: {file: prod.yaml}}}",
+			err:  "marathon.scheme must be http or https. Found: ftp",
+		},
+		{
+			data: "registries: {registry.example.com: {tls: {certFile: cert.pem}}}\nenvironments: {prod: {marathon: {file: prod.yaml}}}",
+			err:  "registries.registry.example.com.tls.certFile and registries.registry.example.com.tls.keyFile must be set together",
+		},
+	}
+	for i, test := range tests {
+		c, err := configLoad([]byte(test.data), flags{env: "prod", configDir: "/deploy"})
+		if err != nil && test.err == "" {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err != nil && err.Error() != test.err {
+			t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.err, err)
+		} else if err == nil {
+			c.Marathon.sources = nil
+			if !reflect.DeepEqual(c.Marathon, test.marathon) {
+				t.Errorf("(%d) Expected marathon %+v, got %+v", i, test.marathon, c.Marathon)
+			}
+			if got := c.Registries["registry.example.com"]; got != test.registry {
+				t.Errorf("(%d) Expected registry %+v, got %+v", i, test.registry, got)
+			}
+		}
+	}
+}
+
+func TestConfigLoadEnvironmentMarathon(t *testing.T) {
+	data := `
+marathon:
+  host: marathon.example.com
+  tls: {caFile: /etc/ca.pem, serverName: marathon}
+  auth: {token: abc}
+  headers:
+    X-Team: [deploy]
+    X-Env: [global]
+environments:
+  prod:
+    marathon:
+      file: prod.yaml
+  staging:
+    marathon:
+      file: staging.yaml
+      host: staging-marathon.example.com
+      scheme: http
+      tls: {insecureSkipVerify: true}
+      auth: {basic: {username: deploy, password: secret}}
+      headers:
+        X-Env: [staging]
+`
+	tests := []struct {
+		flags   flags
+		host    string
+		scheme  string
+		tls     configTLS
+		auth    string
+		headers map[string]string
+		sources map[string]string
+	}{
+		// Top level settings
+		{
+			flags:   flags{env: "prod"},
+			host:    "marathon.example.com",
+			scheme:  "https",
+			tls:     configTLS{CAFile: "/etc/ca.pem", ServerName: "marathon"},
+			auth:    "token",
+			headers: map[string]string{"X-Team": "deploy", "X-Env": "global"},
+			sources: map[string]string{"host": "marathon.host", "tls": "marathon.tls", "auth": "marathon.auth"},
+		},
+		// Environment settings override top level settings
+		{
+			flags:   flags{env: "staging"},
+			host:    "staging-marathon.example.com",
+			scheme:  "http",
+			tls:     configTLS{InsecureSkipVerify: true},
+			auth:    "basic (deploy)",
+			headers: map[string]string{"X-Team": "deploy", "X-Env": "staging"},
+			sources: map[string]string{"host": "environments.staging.marathon.host", "tls": "environments.staging.marathon.tls", "auth": "environments.staging.marathon.auth"},
+		},
+		// Flags override environment settings
+		{
+			flags:   flags{env: "staging", marathonHost: "localhost:8080", marathonCurlOpts: "-H 'X-Env: local'"},
+			host:    "localhost:8080",
+			scheme:  "http",
+			tls:     configTLS{InsecureSkipVerify: true},
+			auth:    "basic (deploy)",
+			headers: map[string]string{"X-Team": "deploy", "X-Env": "local"},
+			sources: map[string]string{"host": "-marathon.host"},
+		},
+	}
+	for i, test := range tests {
+		c, err := configLoad([]byte(data), test.flags)
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+			continue
+		}
+		m := c.Marathon
+		if m.Host != test.host || m.Scheme != test.scheme || m.TLS != test.tls {
+			t.Errorf("(%d) Expected %s://%s %+v, got %s://%s %+v", i, test.scheme, test.host, test.tls, m.Scheme, m.Host, m.TLS)
+		}
+		if got := marathonAuthMethod(m.Auth); got != test.auth {
+			t.Errorf("(%d) Expected auth '%s', got '%s'", i, test.auth, got)
+		}
+		for key, value := range test.headers {
+			if got := m.Headers.Get(key); got != value {
+				t.Errorf("(%d) Expected header %s = '%s', got '%s'", i, key, value, got)
+			}
+		}
+		for key, source := range test.sources {
+			if got := m.sources[key]; got != source {
+				t.Errorf("(%d) Expected %s from '%s', got '%s'", i, key, source, got)
+			}
+		}
+	}
+}
+
+func TestConfigLoadExtends(t *testing.T) {
+	data := `
+marathon:
+  host: marathon.example.com
+image:
+  repository: registry.example.com
+  tagTemplate: latest
+environments:
+  base:
+    marathon:
+      headers:
+        X-Team: [deploy]
+    images:
+      web: {name: web}
+      worker: {name: worker, tagTemplate: stable}
+  staging:
+    extends: base
+    marathon:
+      file: marathon.yaml
+      host: staging-marathon.example.com
+    images:
+      web: {tagTemplate: staging}
+  prod:
+    extends: staging
+    marathon:
+      file: prod.yaml
+      host: prod-marathon.example.com
+    images:
+      web: {repository: prod-registry.example.com}
+  loop1:
+    extends: loop2
+  loop2:
+    extends: loop1
+  orphan:
+    extends: unknown
+`
+	tests := []struct {
+		env        string
+		file       string
+		host       string
+		hostSource string
+		images     map[string]configImage
+		err        string
+	}{
+		{
+			env:        "staging",
+			file:       "marathon.yaml",
+			host:       "staging-marathon.example.com",
+			hostSource: "environments.staging.marathon.host",
+			images: map[string]configImage{
+				"web":    {Name: "web", TagTemplate: "staging"},
+				"worker": {Name: "worker", TagTemplate: "stable"},
+			},
+		},
+		{
+			env:        "prod",
+			file:       "prod.yaml",
+			host:       "prod-marathon.example.com",
+			hostSource: "environments.prod.marathon.host",
+			images: map[string]configImage{
+				"web":    {Repository: "prod-registry.example.com", Name: "web", TagTemplate: "staging"},
+				"worker": {Name: "worker", TagTemplate: "stable"},
+			},
+		},
+		// Environments which are only extended needn't have a Marathon file,
+		// and errors in other environments don't stop staging & prod loading
+		{
+			env: "base",
+			err: "environments.base.marathon.file must be set",
+		},
+		{
+			env: "loop1",
+			err: "Cycle in environments extended by loop1: loop1 -> loop2 -> loop1",
+		},
+		{
+			env: "orphan",
+			err: "Environment orphan extends unknown environment unknown",
+		},
+	}
+	for i, test := range tests {
+		c, err := configLoad([]byte(data), flags{env: test.env})
+		if err != nil && test.err == "" {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+			continue
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+			continue
+		} else if err != nil {
+			if err.Error() != test.err {
+				t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.err, err)
+			}
+			continue
+		}
+		env := c.Environments[test.env]
+		if env.Marathon.File != test.file {
+			t.Errorf("(%d) Expected file '%s', got '%s'", i, test.file, env.Marathon.File)
+		}
+		if c.Marathon.Host != test.host || c.Marathon.sources["host"] != test.hostSource {
+			t.Errorf("(%d) Expected host %s from '%s', got %s from '%s'", i, test.host, test.hostSource, c.Marathon.Host, c.Marathon.sources["host"])
+		}
+		if got := c.Marathon.Headers.Get("X-Team"); got != "deploy" {
+			t.Errorf("(%d) Expected header X-Team = 'deploy', got '%s'", i, got)
+		}
+		if !reflect.DeepEqual(env.Images, test.images) {
+			t.Errorf("(%d) Expected images %+v, got %+v", i, test.images, env.Images)
+		}
+	}
+
+	// Environments which are extended aren't changed
+	c, err := configLoad([]byte(data), flags{env: "prod"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := c.Environments["staging"].Images["web"]; !reflect.DeepEqual(got, configImage{TagTemplate: "staging"}) {
+		t.Errorf("Expected staging web image to be unchanged, got %+v", got)
+	}
+}
+
+func TestConfigLoadExtendsCycle(t *testing.T) {
+	data := `
+environments:
+  prod: {extends: staging}
+  staging: {extends: base}
+  base: {extends: staging}
+`
+	_, err := configLoad([]byte(data), flags{env: "prod"})
+	expected := "Cycle in environments extended by prod: prod -> staging -> base -> staging"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', got '%v'", expected, err)
+	}
+
+	data = "environments: {prod: {extends: unknown}}"
+	_, err = configLoad([]byte(data), flags{env: "prod"})
+	expected = "Environment prod extends unknown environment unknown"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', got '%v'", expected, err)
+	}
+}
+
+func TestConfigLoadVars(t *testing.T) {
+	defer os.Unsetenv("CFDEPLOY_TEST_REGION")
+	os.Setenv("CFDEPLOY_TEST_REGION", "eu") // #nosec G104
+
+	valuesFile, err := ioutil.TempFile("", "values.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error creating values file: %s", err)
+	}
+	defer os.Remove(valuesFile.Name())
+	_, err = valuesFile.WriteString("app: {mem: 1024}\nregion: us\n")
+	if err != nil {
+		t.Fatalf("Unexpected error writing values file: %s", err)
+	}
+	valuesFile.Close() // #nosec G104
+
+	data := `
+environments:
+  staging:
+    marathon: {file: marathon.yaml}
+    vars:
+      instances: 1
+      region: ${CFDEPLOY_TEST_REGION}
+      app: {cpus: 0.5, mem: 512}
+      domains: [staging.example.com]
+  prod:
+    extends: staging
+    vars:
+      instances: 3
+      app: {mem: 2048}
+      domains: [example.com, www.example.com]
+`
+	tests := []struct {
+		flags  flags
+		expect map[string]interface{}
+	}{
+		{
+			flags: flags{env: "staging"},
+			expect: map[string]interface{}{
+				"instances": 1,
+				"region":    "eu",
+				"app":       map[string]interface{}{"cpus": 0.5, "mem": 512},
+				"domains":   []interface{}{"staging.example.com"},
+			},
+		},
+		// Maps are merged, other values are replaced
+		{
+			flags: flags{env: "prod"},
+			expect: map[string]interface{}{
+				"instances": 3,
+				"region":    "eu",
+				"app":       map[string]interface{}{"cpus": 0.5, "mem": 2048},
+				"domains":   []interface{}{"example.com", "www.example.com"},
+			},
+		},
+		// -values files, then -set flags override the environment's vars
+		{
+			flags: flags{
+				env:    "prod",
+				values: flagsList{valuesFile.Name()},
+				set:    flagsList{"instances=5", "app.cpus=1", "app.name=web", "canary=true", "version=1.10"},
+			},
+			expect: map[string]interface{}{
+				"instances": 5,
+				"region":    "us",
+				"app":       map[string]interface{}{"cpus": 1, "mem": 1024, "name": "web"},
+				"domains":   []interface{}{"example.com", "www.example.com"},
+				"canary":    true,
+				"version":   "1.10",
+			},
+		},
+	}
+	for i, test := range tests {
+		c, err := configLoad([]byte(data), test.flags)
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+			continue
+		}
+		if got := c.Environments[test.flags.env].Vars; !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("(%d) Expected vars %#v, got %#v", i, test.expect, got)
+		}
+	}
+}
+
+func TestConfigLoadPartials(t *testing.T) {
+	tests := []struct {
+		data   string
+		expect string
+		err    string
+	}{
+		{data: "environments: {prod: {marathon: {file: prod.yaml}}}", expect: "/deploy/partials"},
+		{data: "partials: marathon/shared\nenvironments: {prod: {marathon: {file: prod.yaml}}}", expect: "/deploy/marathon/shared"},
+		{data: "partials: /etc/partials\nenvironments: {prod: {marathon: {file: prod.yaml}}}", expect: "/etc/partials"},
+		{data: "partials: ../shared\nenvironments: {prod: {marathon: {file: prod.yaml}}}", expect: "/shared"},
+		// The config directory (or one containing it) would parse every file
+		{data: "partials: .\nenvironments: {prod: {marathon: {file: prod.yaml}}}", err: "partials must be a subdirectory of the config directory, or outside it"},
+		{data: "partials: /\nenvironments: {prod: {marathon: {file: prod.yaml}}}", err: "partials must be a subdirectory of the config directory, or outside it"},
+	}
+	for i, test := range tests {
+		c, err := configLoad([]byte(test.data), flags{env: "prod", configDir: "/deploy"})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("(%d) Expected error '%s', got: %v", i, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if c.Partials != test.expect {
+			t.Errorf("(%d) Expected partials '%s', got '%s'", i, test.expect, c.Partials)
+		}
+	}
+}
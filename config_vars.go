@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configLoadVars adds the variables of -values files (in order) and then
+// -set flags to the environment's variables
+func configLoadVars(vars map[string]interface{}, flags flags) (map[string]interface{}, error) {
+	for _, file := range flags.values {
+		data, err := ioutil.ReadFile(file) // #nosec G304
+		if err != nil {
+			return nil, fmt.Errorf("Error reading -values file: %s", err)
+		}
+		var values map[string]interface{}
+		err = yamlUnmarshalStrict(file, data, &values)
+		if err != nil {
+			return nil, err
+		}
+		vars = configMergeVars(vars, values)
+	}
+	for _, set := range flags.set {
+		i := strings.Index(set, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid -set '%s'. Expected key=value", set)
+		}
+		vars = configSetVar(vars, strings.Split(set[:i], "."), configParseVar(set[i+1:]))
+	}
+	return vars, nil
+}
+
+// configMergeVars returns vars overridden by o. Nested maps are merged, and
+// any other values (including lists) are replaced. vars isn't modified.
+func configMergeVars(vars, o map[string]interface{}) map[string]interface{} {
+	if len(o) == 0 {
+		return vars
+	}
+	merged := make(map[string]interface{}, len(vars)+len(o))
+	for key, value := range vars {
+		merged[key] = value
+	}
+	for key, value := range configNormalizeVar(o).(map[string]interface{}) {
+		base, baseOK := merged[key].(map[string]interface{})
+		override, overrideOK := value.(map[string]interface{})
+		if baseOK && overrideOK {
+			value = configMergeVars(base, override)
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// configSetVar returns vars with the variable at path (e.g. [app, cpus]) set
+// to value, creating or replacing maps along the way. vars isn't modified.
+func configSetVar(vars map[string]interface{}, path []string, value interface{}) map[string]interface{} {
+	if len(path) > 1 {
+		child, _ := vars[path[0]].(map[string]interface{})
+		value = configSetVar(child, path[1:], value)
+	}
+	return configMergeVars(vars, map[string]interface{}{path[0]: value})
+}
+
+// configParseVar parses the value of a -set flag, so integers & booleans
+// have their type e.g. -set instances=3. Anything else (including decimals,
+// so a version like 1.10 isn't changed) is a string.
+func configParseVar(s string) interface{} {
+	var value interface{}
+	err := yaml.Unmarshal([]byte(s), &value)
+	if err != nil {
+		return s
+	}
+	switch value.(type) {
+	case int, int64, uint64, bool:
+		return value
+	}
+	return s
+}
+
+// configNormalizeVar converts the map[interface{}]interface{} maps decoded
+// by yaml to map[string]interface{}, so they can be used in templates (e.g.
+// by toJson)
+func configNormalizeVar(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = configNormalizeVar(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = configNormalizeVar(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = configNormalizeVar(item)
+		}
+		return list
+	}
+	return value
+}
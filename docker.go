@@ -2,20 +2,28 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os/exec"
+	"os"
+	"sort"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 )
 
 type dockerImage struct {
 	Repository string
 	Name       string
 	Tag        string
+	Digest     string   // set by dockerCheckImage e.g. "sha256:..."
+	PinDigest  bool     // reference the image by digest instead of tag
+	Platforms  []string // platforms the image must support e.g. "linux/arm64"
+	Registry   configRegistry
+	Registries map[string]configRegistry // settings of every registry e.g. for a token realm on another host
 }
 
 func (i *dockerImage) Validate() error {
@@ -47,45 +55,56 @@ func (i *dockerImage) String() string {
 	return i.Repository + "/" + i.Name + ":" + i.Tag
 }
 
-var dockerTagVars struct {
-	GitBranch   string
-	GitRevCount string
-	GitRevShort string
+// URL returns the registry API URL of a path under the image e.g.
+// "manifests/latest"
+func (i *dockerImage) URL(path string) string {
+	scheme := i.Registry.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, i.Repository, i.Name, path)
 }
 
-// dockerTag renders a tag template
-func dockerTag(tagTemplate string) (string, error) {
-	// Lazy load git vars
-	var err error
-	var out []byte
-	if strings.Contains(tagTemplate, ".GitBranch") && dockerTagVars.GitBranch == "" {
-		/* #nosec */
-		out, err = exec.Command("git", "symbolic-ref", "--short", "HEAD").Output()
-		if err != nil {
-			return "", err
-		}
-		dockerTagVars.GitBranch = strings.TrimSpace(string(out))
+// Reference returns the image reference to deploy, which is pinned to the
+// digest if requested (and known)
+func (i *dockerImage) Reference() string {
+	if i.PinDigest && i.Digest != "" {
+		return i.Repository + "/" + i.Name + "@" + i.Digest
 	}
-	if strings.Contains(tagTemplate, ".GitRevCount") && dockerTagVars.GitRevCount == "" {
-		/* #nosec */
-		out, err = exec.Command("git", "rev-list", "--count", "HEAD").Output()
+	return i.String()
+}
+
+// dockerTagVars are the variables of tag templates
+type dockerTagVars struct {
+	gitVars                   // GitBranch, GitRevFull etc.
+	Env     map[string]string // environment variables e.g. .Env.BUILD_NUMBER
+}
+
+// dockerTag renders a tag template. If requireClean is set, tags using git
+// variables can't be rendered when the working tree has uncommitted changes,
+// as the tag wouldn't match the code.
+func dockerTag(tagTemplate string, requireClean bool) (string, error) {
+	if requireClean && strings.Contains(tagTemplate, ".Git") {
+		err := gitCheckClean("tag template '" + tagTemplate + "'")
 		if err != nil {
 			return "", err
 		}
-		dockerTagVars.GitRevCount = strings.TrimSpace(string(out))
 	}
-	if strings.Contains(tagTemplate, ".GitRevShort") && dockerTagVars.GitRevShort == "" {
-		/* #nosec */
-		out, err = exec.Command("git", "rev-parse", "--short", "HEAD").Output()
-		if err != nil {
-			return "", err
+
+	vars := dockerTagVars{Env: map[string]string{}}
+	for _, env := range os.Environ() {
+		if i := strings.Index(env, "="); i > 0 {
+			vars.Env[env[:i]] = env[i+1:]
 		}
-		dockerTagVars.GitRevShort = strings.TrimSpace(string(out))
 	}
+
 	// Render template
-	t := template.Must(template.New("tagTemplate").Parse(tagTemplate))
+	t, err := fileTemplate("tagTemplate").Parse(tagTemplate)
+	if err != nil {
+		return "", err
+	}
 	var buf bytes.Buffer
-	err = t.Execute(&buf, dockerTagVars)
+	err = t.Execute(&buf, vars)
 	if err != nil {
 		return "", err
 	}
@@ -123,9 +142,9 @@ func dockerImageList(c config, e string) (images map[string]dockerImage, err err
 		}
 		// Add tag
 		if envImage.TagTemplate != "" {
-			image.Tag, err = dockerTag(envImage.TagTemplate)
+			image.Tag, err = dockerTag(envImage.TagTemplate, c.Git.RequireClean)
 		} else if c.Image.TagTemplate != "" {
-			image.Tag, err = dockerTag(c.Image.TagTemplate)
+			image.Tag, err = dockerTag(c.Image.TagTemplate, c.Git.RequireClean)
 		} else {
 			err = fmt.Errorf(
 				"Could not find image tag in config for %s",
@@ -135,188 +154,256 @@ func dockerImageList(c config, e string) (images map[string]dockerImage, err err
 		if err != nil {
 			return
 		}
+		// Pin digest
+		if envImage.Digest != nil {
+			image.PinDigest = *envImage.Digest
+		} else if c.Image.Digest != nil {
+			image.PinDigest = *c.Image.Digest
+		}
+		// Add required platforms
+		if len(envImage.Platforms) > 0 {
+			image.Platforms = envImage.Platforms
+		} else {
+			image.Platforms = c.Image.Platforms
+		}
+		// Add registry connection settings
+		image.Registry = c.Registries[image.Repository]
+		image.Registries = c.Registries
 		// Append image
 		images[imageKey] = image
 	}
 	return
 }
 
-func dockerCheckImage(image dockerImage) error {
+// dockerCheckImage verifies an image exists (for all required platforms)
+// and returns its digest
+func dockerCheckImage(image dockerImage) (digest string, err error) {
 
 	// Validate image fields
-	err := image.Validate()
+	err = image.Validate()
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	client, err := httpClient(image.Registry.TLS)
+	if err != nil {
+		return "", err
+	}
+
+	// The manifest body is needed to check platforms
+	needBody := len(image.Platforms) > 0
+
 	// Attempt to verify image exists without auth
-	authHeader, err := dockerGetImage(image.Repository, image.Name, image.Tag, "")
+	manifest, challenges, err := dockerGetImage(client, image, "", needBody)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// Return if auth not required
-	if authHeader == "" {
-		return nil
+	// Auth required, so build an Authorization header using the
+	// credentials from the Docker CLI config (if any)
+	var authorization string
+	if len(challenges) > 0 {
+		creds, err := dockerGetCredentials(image.Repository)
+		if err != nil {
+			return "", err
+		}
+		tokenClient, err := dockerTokenClient(image, challenges, client)
+		if err != nil {
+			return "", err
+		}
+		authorization, err = dockerAuthorize(challenges, creds, tokenClient)
+		if err != nil {
+			return "", err
+		}
+
+		// Verify image exists with auth
+		manifest, _, err = dockerGetImage(client, image, authorization, needBody)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	// Auth required, so get a signed token (with grant)
-	var authToken string
-	authToken, err = dockerGetToken(authHeader)
-	if err != nil {
-		return err
+	// Check required platforms exist
+	if needBody {
+		err = dockerCheckPlatforms(image, manifest, authorization)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	// Verify image exists with auth
-	_, err = dockerGetImage(image.Repository, image.Name, image.Tag, authToken)
-	return err
+	return manifest.Digest, nil
 
 }
 
-// dockerGetImage will query the image manifest to verify an image exists.
-// if the response is a 401 and contains a Www-Authenticate header,
-// it will be returned in authHeader. if an error occurs, err will be returned.
-// if the image is found, authHeader and err will be empty.
-func dockerGetImage(imageRepo, imageName, imageTag, token string) (authHeader string, err error) {
-	// Build registry URL for image/tag
-	url := fmt.Sprintf(
-		"https://%s/v2/%s/manifests/%s",
-		imageRepo,
-		imageName,
-		imageTag,
-	)
-	// Build request
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		err = fmt.Errorf("Error building request: %s", err)
-		return
-	}
-	req.Header = http.Header{
-		"Content-Type": []string{
-			"application/json; charset=utf-8",
-		},
-	}
-	if token != "" {
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+// dockerCheckImages checks images concurrently, with at most concurrency
+// checks running at once. The digests of the images found are returned
+// (keyed like images), along with an error listing every image which could
+// not be verified.
+func dockerCheckImages(images map[string]dockerImage, concurrency int) (map[string]string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	type result struct {
+		key    string
+		digest string
+		err    error
+	}
+	keys := make(chan string)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(images); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				digest, err := dockerCheckImage(images[key])
+				results <- result{key: key, digest: digest, err: err}
+			}
+		}()
 	}
-	// Make request
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	go func() {
+		for key := range images {
+			keys <- key
+		}
+		close(keys)
+		wg.Wait()
+		close(results)
+	}()
+
+	// Collect results
+	digests := map[string]string{}
+	var errs []string
+	for r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", r.key, r.err))
+			continue
+		}
+		digests[r.key] = r.digest
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return digests, fmt.Errorf(
+			"%d of %d docker images could not be verified:\n* %s",
+			len(errs),
+			len(images),
+			strings.Join(errs, "\n* "),
+		)
 	}
-	// Check if auth is required
-	if resp.StatusCode == 401 {
-		if token != "" {
-			err = fmt.Errorf(
-				"HTTP response should not be 401 when token is provided",
-			)
+	return digests, nil
+}
+
+// dockerGetImage will query the image manifest to verify an image exists.
+// if the response is a 401 and contains Www-Authenticate headers, the
+// parsed challenges will be returned. if an error occurs, err will be
+// returned. if the image is found, its manifest is returned and challenges
+// and err will be empty. Unless needBody is true, a HEAD request is tried
+// first, in which case the manifest body will be empty.
+func dockerGetImage(client *http.Client, image dockerImage, authorization string, needBody bool) (manifest dockerManifest, challenges []dockerChallenge, err error) {
+	// Build registry URL for image/tag
+	url := image.URL("manifests/" + image.Tag)
+	// Try HEAD first, as the body isn't needed if the registry returns the
+	// media type & digest
+	method := "HEAD"
+	if needBody {
+		method = "GET"
+	}
+	for {
+		var resp *http.Response
+		var respBody []byte
+		resp, respBody, err = dockerManifestRequest(client, method, url, authorization)
+		if err != nil {
 			return
 		}
-		// Get WWW-Authenticate header
-		authHeader = resp.Header.Get("Www-Authenticate")
-		if authHeader == "" {
+		// Check if auth is required
+		if resp.StatusCode == 401 {
+			if authorization != "" {
+				err = fmt.Errorf(
+					"HTTP response should not be 401 when authorization is provided",
+				)
+				return
+			}
+			// Get WWW-Authenticate headers
+			challenges = dockerParseChallenges(resp.Header["Www-Authenticate"])
+			if len(challenges) == 0 {
+				err = fmt.Errorf(
+					"Expected 401 response to contain Www-Authenticate error",
+				)
+			}
+			return
+		}
+		// Check if image/tag not found
+		if resp.StatusCode == 404 {
 			err = fmt.Errorf(
-				"Expected 401 response to contain Www-Authenticate error",
+				"Docker image/tag (%s/%s:%s) not found",
+				image.Repository,
+				image.Name,
+				image.Tag,
 			)
+			return
 		}
-		return
-	}
-	// Check if image/tag not found
-	if resp.StatusCode == 404 {
-		err = fmt.Errorf(
-			"Docker image/tag (%s/%s:%s) not found",
-			imageRepo,
-			imageName,
-			imageTag,
-		)
-		return
-	}
-	// Check request was valid
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf(
-			"Response code not 200, got: %d",
-			resp.StatusCode,
-		)
-		return
-	}
-	// Get response
-	respBody, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close() // #nosec G104
-	if err != nil {
-		err = fmt.Errorf(
-			"Error reading response: %s",
-			err,
-		)
-		return
-	}
-	// Parse response
-	var searchResult struct {
-		Name  string
-		Tag   string
-		Error struct {
-			Code    string
-			Message string
-			Detail  struct {
-				Type   string
-				Name   string
-				Action string
+		manifest = dockerManifest{
+			MediaType: dockerMediaType(resp.Header.Get("Content-Type")),
+			Digest:    resp.Header.Get("Docker-Content-Digest"),
+			Body:      respBody,
+		}
+		// Use HEAD response if it's complete, otherwise GET the manifest
+		if method == "HEAD" {
+			if resp.StatusCode == 200 && manifest.Digest != "" && dockerMediaTypeKnown(manifest.MediaType) {
+				return
 			}
+			method = "GET"
+			continue
+		}
+		// Check request was valid
+		if resp.StatusCode != 200 {
+			err = fmt.Errorf(
+				"GET %s\nResponse code not 200, got: %d\n%s",
+				url,
+				resp.StatusCode,
+				dockerRegistryErrors(respBody),
+			)
+			return
 		}
+		break
 	}
-	err = json.Unmarshal(respBody, &searchResult)
+	// Validate manifest based on its media type
+	manifest.MediaType, err = dockerValidateManifest(manifest.MediaType, manifest.Body)
 	if err != nil {
-		err = fmt.Errorf("Error parsing response json: %s", err)
+		err = fmt.Errorf("GET %s\n%s", url, err)
 		return
 	}
-	// Check response values
-	if searchResult.Error.Code != "" {
-		err = fmt.Errorf(
-			"GET %s\nRegistry search error (%s): %s",
-			url,
-			searchResult.Error.Code,
-			searchResult.Error.Message,
-		)
-		return
-	}
-	if searchResult.Name == "" || searchResult.Tag == "" {
-		err = fmt.Errorf(
-			"GET %s\nImage name/tag invalid: %+v",
-			url,
-			searchResult,
-		)
+	// Get digest of manifest
+	if manifest.Digest == "" {
+		manifest.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(manifest.Body))
 	}
 	return
 }
 
-// dockerGetToken will get a secure Docker registry token
-func dockerGetToken(authHeader string) (string, error) {
-	// Extract auth realm/service/scope from auth header
-	var realm, service, scope string
-	wwwAuthTrimmed := strings.TrimPrefix(authHeader, "Bearer ")
-	wwwAuthSplit := strings.Split(string(wwwAuthTrimmed), ",")
-	for _, wwwAuthPart := range wwwAuthSplit {
-		wwwAuth := strings.Trim(wwwAuthPart, " ")
-		if wwwAuth == "" {
-			continue
-		}
-		wwwAuthSplit := strings.Split(wwwAuth, "=")
-		if len(wwwAuthSplit) != 2 {
-			continue
-		}
-		value := strings.TrimSpace(strings.Trim(wwwAuthSplit[1], "\""))
-		switch wwwAuthSplit[0] {
-		case "realm":
-			realm = value
-		case "service":
-			service = value
-		case "scope":
-			scope = value
-		}
+// dockerManifestRequest requests a manifest, accepting all supported
+// manifest media types
+func dockerManifestRequest(client *http.Client, method, url, authorization string) (*http.Response, []byte, error) {
+	header := http.Header{
+		"Accept": []string{strings.Join(dockerManifestMediaTypes, ", ")},
+	}
+	if authorization != "" {
+		header.Set("Authorization", authorization)
 	}
-	if realm == "" || service == "" || scope == "" {
-		return "", fmt.Errorf(
-			"Realm, service or scope empty (realm: '%s', service: '%s', scope '%s')",
+	return httpDo(client, method, url, header, nil)
+}
+
+// dockerGetToken will get a secure Docker registry token for a Bearer
+// challenge. If credentials are given they are sent to the token realm,
+// otherwise an anonymous token is requested. The token is returned along
+// with the time it expires. The registry's client is used, as the token
+// server is often the registry itself.
+func dockerGetToken(challenge dockerChallenge, creds dockerCredentials, client *http.Client) (dockerToken, error) {
+	// Get auth realm/service/scope from challenge
+	realm := challenge.Params["realm"]
+	service := challenge.Params["service"]
+	scope := challenge.Params["scope"]
+	if realm == "" {
+		return dockerToken{}, fmt.Errorf(
+			"Realm empty (realm: '%s', service: '%s', scope '%s')",
 			realm,
 			service,
 			scope,
@@ -325,54 +412,71 @@ func dockerGetToken(authHeader string) (string, error) {
 	// Build auth URL
 	reqURL, err := url.Parse(realm)
 	if err != nil {
-		return "", fmt.Errorf(
+		return dockerToken{}, fmt.Errorf(
 			"Error parsing realm URL: %s",
 			err,
 		)
 	}
 	reqQuery := url.Values{}
-	reqQuery.Add("service", service)
-	reqQuery.Add("scope", scope)
+	if service != "" {
+		reqQuery.Add("service", service)
+	}
+	if scope != "" {
+		reqQuery.Add("scope", scope)
+	}
 	reqURL.RawQuery = reqQuery.Encode()
 	authURL := reqURL.String()
 	// Request auth token
-	resp, err := http.Get(authURL) // #nosec G107
+	header := http.Header{}
+	if creds.Username != "" || creds.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+		header.Set("Authorization", "Basic "+auth)
+	}
+	resp, respBody, err := httpDo(client, "GET", authURL, header, nil)
 	if err != nil {
-		return "", fmt.Errorf(
+		return dockerToken{}, fmt.Errorf(
 			"GET %s\n%s",
 			authURL,
 			err,
 		)
 	}
-	// Get response
-	respBody, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close() // #nosec G104
-	if err != nil {
-		return "", fmt.Errorf(
-			"GET %s\nError reading response: %s",
+	// Check credentials were accepted
+	if resp.StatusCode == 401 || resp.StatusCode == 403 {
+		return dockerToken{}, fmt.Errorf(
+			"GET %s\nAuth failed (%s). Check the credentials in %s",
 			authURL,
-			err,
+			resp.Status,
+			dockerConfigPath(),
 		)
 	}
 	// Parse response
 	var respObject struct {
-		Token string
+		Token       string
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		IssuedAt    string `json:"issued_at"`
 	}
 	err = json.Unmarshal(respBody, &respObject)
 	if err != nil {
-		return "", fmt.Errorf(
+		return dockerToken{}, fmt.Errorf(
 			"GET %s\nError parsing json: %s",
 			authURL,
 			err,
 		)
 	}
-	// Check token valid
+	// Check token valid (some registries only return access_token)
+	if respObject.Token == "" {
+		respObject.Token = respObject.AccessToken
+	}
 	if respObject.Token == "" {
-		return "", fmt.Errorf(
+		return dockerToken{}, fmt.Errorf(
 			"GET %s\nAuth token invalid. Response: %+v",
 			authURL,
 			respObject,
 		)
 	}
-	return respObject.Token, nil
+	return dockerToken{
+		Token:   respObject.Token,
+		Expires: dockerTokenExpires(respObject.ExpiresIn, respObject.IssuedAt, time.Now()),
+	}, nil
 }
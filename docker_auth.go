@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dockerHubServer is the key Docker uses for Docker Hub credentials
+const dockerHubServer = "https://index.docker.io/v1/"
+
+type dockerCredentials struct {
+	Username string
+	Password string
+}
+
+// dockerConfigFile is the subset of ~/.docker/config.json used for auth
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+var dockerAuth struct {
+	sync.Mutex
+	config      *dockerConfigFile
+	credentials map[string]dockerCredentials
+}
+
+// dockerConfigPath returns the path of the Docker CLI config file
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// dockerLoadConfigFile reads the Docker CLI config file. A missing file is
+// not an error, as anonymous access may be enough.
+func dockerLoadConfigFile(path string) (dockerConfigFile, error) {
+	var c dockerConfigFile
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("Error parsing '%s': %s", path, err)
+	}
+	return c, nil
+}
+
+// dockerServerName normalises a registry host or config key so they can be
+// compared e.g. "https://index.docker.io/v1/" => "index.docker.io"
+func dockerServerName(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	if i := strings.Index(server, "/"); i >= 0 {
+		server = server[:i]
+	}
+	switch server {
+	case "docker.io", "registry-1.docker.io":
+		return "index.docker.io"
+	}
+	return server
+}
+
+// dockerCredentialServer returns the server URL passed to credential
+// helpers for a registry host
+func dockerCredentialServer(registry string) string {
+	if dockerServerName(registry) == "index.docker.io" {
+		return dockerHubServer
+	}
+	return registry
+}
+
+// dockerConfigCredentials finds the credentials for a registry host in a
+// Docker CLI config, running credential helpers if configured
+func dockerConfigCredentials(c dockerConfigFile, registry string) (dockerCredentials, error) {
+	name := dockerServerName(registry)
+
+	// Registry specific credential helper
+	for server, helper := range c.CredHelpers {
+		if dockerServerName(server) == name {
+			return dockerHelperCredentials(helper, dockerCredentialServer(registry))
+		}
+	}
+
+	// Default credential store
+	if c.CredsStore != "" {
+		return dockerHelperCredentials(c.CredsStore, dockerCredentialServer(registry))
+	}
+
+	// Base64 encoded auths
+	for server, auth := range c.Auths {
+		if dockerServerName(server) != name {
+			continue
+		}
+		if auth.Auth == "" {
+			return dockerCredentials{Username: auth.Username, Password: auth.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return dockerCredentials{}, fmt.Errorf("Error decoding auth for %s: %s", server, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return dockerCredentials{}, fmt.Errorf("Invalid auth for %s", server)
+		}
+		return dockerCredentials{Username: parts[0], Password: parts[1]}, nil
+	}
+
+	return dockerCredentials{}, nil
+}
+
+// dockerHelperCredentials gets credentials from a docker-credential-* helper
+func dockerHelperCredentials(helper, server string) (dockerCredentials, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get") // #nosec G204
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if e, ok := err.(*exec.Error); ok && e.Err == exec.ErrNotFound {
+		// e.g. a credsStore set by Docker Desktop on another machine. Public
+		// images can still be checked anonymously.
+		log.Printf(
+			"Warning: docker-credential-%s not found, checking %s without credentials\n",
+			helper,
+			server,
+		)
+		return dockerCredentials{}, nil
+	}
+	if err != nil {
+		// Helpers exit non-zero when they have no credentials for the server
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return dockerCredentials{}, nil
+		}
+		return dockerCredentials{}, fmt.Errorf(
+			"Error running docker-credential-%s: %s %s",
+			helper,
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &resp)
+	if err != nil {
+		return dockerCredentials{}, fmt.Errorf(
+			"Error parsing docker-credential-%s response: %s",
+			helper,
+			err,
+		)
+	}
+	return dockerCredentials{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// dockerGetCredentials returns the credentials configured for a registry
+// host in the Docker CLI config. Empty credentials are returned if none are
+// configured.
+func dockerGetCredentials(registry string) (dockerCredentials, error) {
+	dockerAuth.Lock()
+	defer dockerAuth.Unlock()
+	if creds, ok := dockerAuth.credentials[registry]; ok {
+		return creds, nil
+	}
+	if dockerAuth.config == nil {
+		c, err := dockerLoadConfigFile(dockerConfigPath())
+		if err != nil {
+			return dockerCredentials{}, err
+		}
+		dockerAuth.config = &c
+		dockerAuth.credentials = map[string]dockerCredentials{}
+	}
+	creds, err := dockerConfigCredentials(*dockerAuth.config, registry)
+	if err != nil {
+		return dockerCredentials{}, err
+	}
+	redactAddValue(creds.Password)
+	dockerAuth.credentials[registry] = creds
+	return creds, nil
+}
+
+// dockerChallenge is an auth challenge from a Www-Authenticate header
+// e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+type dockerChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// dockerParseChallenges parses Www-Authenticate headers. A single header may
+// contain multiple comma separated challenges, and quoted parameter values
+// may contain commas.
+func dockerParseChallenges(headers []string) []dockerChallenge {
+	var challenges []dockerChallenge
+	for _, header := range headers {
+		s := header
+		current := -1
+		for {
+			s = strings.TrimLeft(s, " \t,")
+			if s == "" {
+				break
+			}
+			token, rest := dockerReadToken(s)
+			if token == "" {
+				// Invalid character, ignore the rest of the header
+				break
+			}
+			rest = strings.TrimLeft(rest, " \t")
+			// Parameter of the current challenge
+			if strings.HasPrefix(rest, "=") && current >= 0 {
+				var value string
+				value, s = dockerReadValue(strings.TrimLeft(rest[1:], " \t"))
+				challenges[current].Params[strings.ToLower(token)] = value
+				continue
+			}
+			// Start of a new challenge
+			challenges = append(challenges, dockerChallenge{
+				Scheme: token,
+				Params: map[string]string{},
+			})
+			current = len(challenges) - 1
+			s = rest
+		}
+	}
+	return challenges
+}
+
+// dockerReadToken reads a scheme or parameter name
+func dockerReadToken(s string) (token, rest string) {
+	i := strings.IndexAny(s, " \t,=\"")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// dockerReadValue reads a parameter value, which may be quoted
+func dockerReadValue(s string) (value, rest string) {
+	if !strings.HasPrefix(s, "\"") {
+		i := strings.IndexAny(s, " \t,")
+		if i < 0 {
+			return s, ""
+		}
+		return s[:i], s[i:]
+	}
+	var buf bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				buf.WriteByte(s[i])
+			}
+		case '"':
+			return buf.String(), s[i+1:]
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	// Unterminated quote
+	return buf.String(), ""
+}
+
+// dockerTokenClient returns the client used to request a token from the
+// realm of a Bearer challenge. The registry's client (with its TLS settings
+// e.g. client certificate) is only used if the realm is on the registry's
+// host. Otherwise the realm host's own registries settings are used, if any.
+func dockerTokenClient(image dockerImage, challenges []dockerChallenge, client *http.Client) (*http.Client, error) {
+	for _, challenge := range challenges {
+		if !strings.EqualFold(challenge.Scheme, "Bearer") {
+			continue
+		}
+		realm, err := url.Parse(challenge.Params["realm"])
+		if err != nil || realm.Host == "" {
+			return client, nil // reported by dockerGetToken
+		}
+		registryHost := image.Repository
+		if host, _, err := net.SplitHostPort(registryHost); err == nil {
+			registryHost = host
+		}
+		if strings.EqualFold(realm.Hostname(), registryHost) {
+			return client, nil
+		}
+		return httpClient(image.Registries[realm.Host].TLS)
+	}
+	return client, nil
+}
+
+// dockerAuthorize builds an Authorization header value answering one of the
+// challenges. Bearer challenges are preferred as they don't send the
+// credentials to the registry itself.
+func dockerAuthorize(challenges []dockerChallenge, creds dockerCredentials, client *http.Client) (string, error) {
+	var schemes []string
+	for _, challenge := range challenges {
+		if strings.EqualFold(challenge.Scheme, "Bearer") {
+			token, err := dockerCachedToken(challenge, creds, client)
+			if err != nil {
+				return "", err
+			}
+			return "Bearer " + token, nil
+		}
+		schemes = append(schemes, challenge.Scheme)
+	}
+	for _, challenge := range challenges {
+		if strings.EqualFold(challenge.Scheme, "Basic") {
+			if creds.Username == "" && creds.Password == "" {
+				return "", fmt.Errorf(
+					"Registry requires Basic auth (realm: '%s') but no credentials found in %s",
+					challenge.Params["realm"],
+					dockerConfigPath(),
+				)
+			}
+			auth := base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+			redactAddValue(auth)
+			return "Basic " + auth, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"Unsupported registry auth scheme(s): %s",
+		strings.Join(schemes, ", "),
+	)
+}
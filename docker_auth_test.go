@@ -0,0 +1,265 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDockerConfigCredentials(t *testing.T) {
+	// Fake credential helper
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	helper := "#!/bin/sh\n" +
+		"read server\n" +
+		"if [ \"$server\" = \"https://index.docker.io/v1/\" ] || [ \"$server\" = \"registry.example.com\" ]; then\n" +
+		"  echo '{\"ServerURL\":\"'$server'\",\"Username\":\"helper-user\",\"Secret\":\"helper-secret\"}'\n" +
+		"else\n" +
+		"  echo 'credentials not found in native keychain'\n" +
+		"  exit 1\n" +
+		"fi\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0700) // #nosec G306
+	if err != nil {
+		t.Fatalf("Unexpected error writing helper: %s", err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH")) // #nosec G104
+
+	tests := []struct {
+		config   string
+		registry string
+		expect   dockerCredentials
+	}{
+		// Base64 auth
+		{
+			config:   `{"auths": {"https://registry.example.com": {"auth": "dXNlcjpwYXNzOndvcmQ="}}}`,
+			registry: "registry.example.com",
+			expect:   dockerCredentials{Username: "user", Password: "pass:word"},
+		},
+		// Docker Hub
+		{
+			config:   `{"auths": {"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="}}}`,
+			registry: "index.docker.io",
+			expect:   dockerCredentials{Username: "hub", Password: "secret"},
+		},
+		// No credentials
+		{
+			config:   `{"auths": {"other.example.com": {"auth": "dXNlcjpwYXNz"}}}`,
+			registry: "registry.example.com",
+			expect:   dockerCredentials{},
+		},
+		// Registry specific helper takes priority
+		{
+			config:   `{"auths": {"registry.example.com": {}}, "credHelpers": {"registry.example.com": "test"}}`,
+			registry: "registry.example.com",
+			expect:   dockerCredentials{Username: "helper-user", Password: "helper-secret"},
+		},
+		// Default store
+		{
+			config:   `{"credsStore": "test"}`,
+			registry: "docker.io",
+			expect:   dockerCredentials{Username: "helper-user", Password: "helper-secret"},
+		},
+		// Default store without credentials for registry
+		{
+			config:   `{"credsStore": "test"}`,
+			registry: "other.example.com",
+			expect:   dockerCredentials{},
+		},
+		// Helper not installed, so anonymous
+		{
+			config:   `{"credsStore": "cfdeploy-missing", "auths": {"registry.example.com": {}}}`,
+			registry: "registry.example.com",
+			expect:   dockerCredentials{},
+		},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "config.json")
+		err := ioutil.WriteFile(path, []byte(test.config), 0600)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error writing config: %s", i, err)
+		}
+		c, err := dockerLoadConfigFile(path)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error loading config: %s", i, err)
+		}
+		creds, err := dockerConfigCredentials(c, test.registry)
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if creds != test.expect {
+			t.Errorf("(%d) Expected %+v, got %+v", i, test.expect, creds)
+		}
+	}
+}
+
+func TestDockerGetTokenCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:private/svc:pull" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"token": "abc"}`)) // #nosec G104
+	}))
+	defer server.Close()
+
+	challenge := dockerChallenge{
+		Scheme: "Bearer",
+		Params: map[string]string{
+			"realm":   server.URL + "/token",
+			"service": "registry.example.com",
+			"scope":   "repository:private/svc:pull",
+		},
+	}
+	token, err := dockerGetToken(challenge, dockerCredentials{Username: "user", Password: "pass"}, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if token.Token != "abc" {
+		t.Errorf("Expected token 'abc', got '%s'", token.Token)
+	}
+	_, err = dockerGetToken(challenge, dockerCredentials{Username: "user", Password: "wrong"}, http.DefaultClient)
+	if err == nil {
+		t.Errorf("Expected error with invalid credentials")
+	}
+}
+
+func TestDockerParseChallenges(t *testing.T) {
+	tests := []struct {
+		headers []string
+		expect  []dockerChallenge
+	}{
+		{
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/hello-world:pull"`},
+			expect: []dockerChallenge{
+				{Scheme: "Bearer", Params: map[string]string{
+					"realm":   "https://auth.docker.io/token",
+					"service": "registry.docker.io",
+					"scope":   "repository:library/hello-world:pull",
+				}},
+			},
+		},
+		{
+			headers: []string{`Basic realm="Registry Realm"`},
+			expect: []dockerChallenge{
+				{Scheme: "Basic", Params: map[string]string{"realm": "Registry Realm"}},
+			},
+		},
+		// Multiple challenges in one header, quoted commas & escapes
+		{
+			headers: []string{`Basic realm="a, \"b\"", Bearer realm="https://auth.example.com/token", service=registry, scope="repository:a:pull,push"`},
+			expect: []dockerChallenge{
+				{Scheme: "Basic", Params: map[string]string{"realm": `a, "b"`}},
+				{Scheme: "Bearer", Params: map[string]string{
+					"realm":   "https://auth.example.com/token",
+					"service": "registry",
+					"scope":   "repository:a:pull,push",
+				}},
+			},
+		},
+		// Multiple headers
+		{
+			headers: []string{`Negotiate`, `Basic realm=x`},
+			expect: []dockerChallenge{
+				{Scheme: "Negotiate", Params: map[string]string{}},
+				{Scheme: "Basic", Params: map[string]string{"realm": "x"}},
+			},
+		},
+		{
+			headers: []string{""},
+			expect:  nil,
+		},
+	}
+	for i, test := range tests {
+		got := dockerParseChallenges(test.headers)
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("(%d) Expected %+v, got %+v", i, test.expect, got)
+		}
+	}
+}
+
+func TestDockerAuthorize(t *testing.T) {
+	basic := []dockerChallenge{{Scheme: "Basic", Params: map[string]string{"realm": "x"}}}
+	tests := []struct {
+		challenges []dockerChallenge
+		creds      dockerCredentials
+		expect     string
+		err        bool
+	}{
+		{
+			challenges: basic,
+			creds:      dockerCredentials{Username: "user", Password: "pass"},
+			expect:     "Basic dXNlcjpwYXNz",
+		},
+		{
+			challenges: basic,
+			err:        true,
+		},
+		{
+			challenges: []dockerChallenge{{Scheme: "Negotiate", Params: map[string]string{}}},
+			err:        true,
+		},
+	}
+	for i, test := range tests {
+		got, err := dockerAuthorize(test.challenges, test.creds, http.DefaultClient)
+		if err != nil && !test.err {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.err {
+			t.Errorf("(%d) Expected error but no error occurred", i)
+		} else if got != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+func TestDockerTokenClient(t *testing.T) {
+	registryClient := &http.Client{Transport: &http.Transport{}}
+	authTLS := configTLS{InsecureSkipVerify: true}
+	image := dockerImage{
+		Repository: "registry.example.com:5000",
+		Registry:   configRegistry{TLS: configTLS{CertFile: "client.pem", KeyFile: "client-key.pem"}},
+		Registries: map[string]configRegistry{"auth.example.com": {TLS: authTLS}},
+	}
+	defaultClient, err := httpClient(configTLS{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	authClient, err := httpClient(authTLS)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	bearer := func(realm string) []dockerChallenge {
+		return []dockerChallenge{{Scheme: "Bearer", Params: map[string]string{"realm": realm}}}
+	}
+	tests := []struct {
+		challenges []dockerChallenge
+		expect     http.RoundTripper
+	}{
+		// Realm on the registry's host
+		{challenges: bearer("https://registry.example.com:5000/token"), expect: registryClient.Transport},
+		{challenges: bearer("https://registry.example.com/token"), expect: registryClient.Transport},
+		// Realm on another host doesn't get the registry's TLS settings
+		{challenges: bearer("https://auth.docker.io/token"), expect: defaultClient.Transport},
+		{challenges: bearer("https://auth.example.com/token"), expect: authClient.Transport},
+		{challenges: []dockerChallenge{{Scheme: "Basic", Params: map[string]string{}}}, expect: registryClient.Transport},
+	}
+	for i, test := range tests {
+		client, err := dockerTokenClient(image, test.challenges, registryClient)
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if client.Transport != test.expect {
+			t.Errorf("(%d) Expected transport %v, got %v", i, test.expect, client.Transport)
+		}
+	}
+}
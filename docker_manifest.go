@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Manifest media types
+const (
+	dockerMediaTypeManifestV1       = "application/vnd.docker.distribution.manifest.v1+json"
+	dockerMediaTypeManifestV1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	dockerMediaTypeManifestV2       = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerMediaTypeManifestList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerMediaTypeOCIManifest      = "application/vnd.oci.image.manifest.v1+json"
+	dockerMediaTypeOCIIndex         = "application/vnd.oci.image.index.v1+json"
+)
+
+// dockerManifestMediaTypes are sent in the Accept header, most preferred
+// first
+var dockerManifestMediaTypes = []string{
+	dockerMediaTypeOCIIndex,
+	dockerMediaTypeManifestList,
+	dockerMediaTypeOCIManifest,
+	dockerMediaTypeManifestV2,
+	dockerMediaTypeManifestV1Signed,
+	dockerMediaTypeManifestV1,
+}
+
+// dockerManifest is a manifest returned by the registry
+type dockerManifest struct {
+	MediaType string
+	Digest    string
+	Body      []byte // empty if the manifest was found with a HEAD request
+}
+
+// dockerManifestBody is the union of the manifest formats' fields used by
+// cfdeploy
+type dockerManifestBody struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+	// Schema 1
+	Name         string `json:"name"`
+	Tag          string `json:"tag"`
+	Architecture string `json:"architecture"`
+	// Image manifest
+	Config *struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"config"`
+	// Manifest list / image index
+	Manifests []struct {
+		MediaType string          `json:"mediaType"`
+		Digest    string          `json:"digest"`
+		Platform  *dockerPlatform `json:"platform"`
+	} `json:"manifests"`
+}
+
+// dockerPlatform is the platform of an image e.g. linux/arm64/v8
+type dockerPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant"`
+}
+
+func (p dockerPlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// dockerParsePlatform parses a platform in os/arch[/variant] format
+func dockerParsePlatform(s string) (dockerPlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return dockerPlatform{}, fmt.Errorf(
+			"Invalid platform '%s'. Expected os/arch[/variant] e.g. linux/amd64",
+			s,
+		)
+	}
+	p := dockerPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// Matches returns true if platform p provides the required platform. The
+// variant is only compared if the required platform has one.
+func (p dockerPlatform) Matches(required dockerPlatform) bool {
+	return p.OS == required.OS &&
+		p.Architecture == required.Architecture &&
+		(required.Variant == "" || p.Variant == required.Variant)
+}
+
+// dockerMediaType returns the media type of a Content-Type header without
+// parameters e.g. charset
+func dockerMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.TrimSpace(contentType)
+	}
+	return mediaType
+}
+
+// dockerMediaTypeKnown returns true if the media type is a supported manifest
+func dockerMediaTypeKnown(mediaType string) bool {
+	for _, known := range dockerManifestMediaTypes {
+		if mediaType == known {
+			return true
+		}
+	}
+	return false
+}
+
+// dockerMediaTypeIndex returns true if the media type is a manifest list /
+// image index
+func dockerMediaTypeIndex(mediaType string) bool {
+	return mediaType == dockerMediaTypeManifestList || mediaType == dockerMediaTypeOCIIndex
+}
+
+// dockerParseManifest parses a manifest body and determines its media type.
+// Registries may return a generic Content-Type (e.g. application/json), in
+// which case the mediaType field or schemaVersion is used.
+func dockerParseManifest(mediaType string, body []byte) (string, dockerManifestBody, error) {
+	var m dockerManifestBody
+	err := json.Unmarshal(body, &m)
+	if err != nil {
+		return "", m, fmt.Errorf("Error parsing manifest json: %s", err)
+	}
+	if !dockerMediaTypeKnown(mediaType) {
+		switch {
+		case m.MediaType != "":
+			mediaType = m.MediaType
+		case m.SchemaVersion == 1:
+			mediaType = dockerMediaTypeManifestV1
+		case m.SchemaVersion == 2 && len(m.Manifests) > 0:
+			mediaType = dockerMediaTypeOCIIndex
+		case m.SchemaVersion == 2 && m.Config != nil:
+			mediaType = dockerMediaTypeOCIManifest
+		}
+	}
+	return mediaType, m, nil
+}
+
+// dockerValidateManifest checks a manifest body has the fields required by
+// its media type, and returns the media type
+func dockerValidateManifest(mediaType string, body []byte) (string, error) {
+	mediaType, m, err := dockerParseManifest(mediaType, body)
+	if err != nil {
+		return "", err
+	}
+	switch mediaType {
+	case dockerMediaTypeManifestV1, dockerMediaTypeManifestV1Signed:
+		if m.Name == "" || m.Tag == "" {
+			return "", fmt.Errorf("Image name/tag invalid (name: '%s', tag: '%s')", m.Name, m.Tag)
+		}
+	case dockerMediaTypeManifestV2, dockerMediaTypeOCIManifest:
+		if m.Config == nil || m.Config.Digest == "" {
+			return "", fmt.Errorf("Image manifest has no config digest")
+		}
+	case dockerMediaTypeManifestList, dockerMediaTypeOCIIndex:
+		if len(m.Manifests) == 0 {
+			return "", fmt.Errorf("Image index has no manifests")
+		}
+	default:
+		return "", fmt.Errorf("Unsupported manifest media type '%s'", mediaType)
+	}
+	return mediaType, nil
+}
+
+// dockerRegistryErrors formats the errors in a registry error response
+func dockerRegistryErrors(body []byte) string {
+	var resp struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &resp) != nil || len(resp.Errors) == 0 {
+		return string(body)
+	}
+	var errs []string
+	for _, e := range resp.Errors {
+		errs = append(errs, fmt.Sprintf("Registry error (%s): %s", e.Code, e.Message))
+	}
+	return strings.Join(errs, "\n")
+}
+
+// dockerManifestPlatforms returns the platforms of an image. For image
+// indexes these are listed in the manifest, otherwise they are read from
+// the image config blob.
+func dockerManifestPlatforms(image dockerImage, manifest dockerManifest, authorization string) ([]dockerPlatform, error) {
+	mediaType, m, err := dockerParseManifest(manifest.MediaType, manifest.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case dockerMediaTypeIndex(mediaType):
+		var platforms []dockerPlatform
+		for _, child := range m.Manifests {
+			if child.Platform != nil {
+				platforms = append(platforms, *child.Platform)
+			}
+		}
+		return platforms, nil
+	case mediaType == dockerMediaTypeManifestV1 || mediaType == dockerMediaTypeManifestV1Signed:
+		// Schema 1 only supports linux images
+		return []dockerPlatform{{OS: "linux", Architecture: m.Architecture}}, nil
+	case m.Config != nil && m.Config.Digest != "":
+		blob, err := dockerGetBlob(image, m.Config.Digest, authorization)
+		if err != nil {
+			return nil, err
+		}
+		var platform dockerPlatform
+		err = json.Unmarshal(blob, &platform)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing image config json: %s", err)
+		}
+		return []dockerPlatform{platform}, nil
+	}
+	return nil, fmt.Errorf("Unable to get platforms of manifest type '%s'", mediaType)
+}
+
+// dockerCheckPlatforms returns an error listing every platform required by
+// the image which is missing from the manifest
+func dockerCheckPlatforms(image dockerImage, manifest dockerManifest, authorization string) error {
+	available, err := dockerManifestPlatforms(image, manifest, authorization)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, s := range image.Platforms {
+		required, err := dockerParsePlatform(s)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, platform := range available {
+			if platform.Matches(required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, s)
+		}
+	}
+	if len(missing) > 0 {
+		var availableNames []string
+		for _, platform := range available {
+			availableNames = append(availableNames, platform.String())
+		}
+		return fmt.Errorf(
+			"Docker image %s is missing platform(s) %s (found: %s)",
+			image.String(),
+			strings.Join(missing, ", "),
+			strings.Join(availableNames, ", "),
+		)
+	}
+	return nil
+}
+
+// dockerGetBlob downloads a blob of an image e.g. its config
+func dockerGetBlob(image dockerImage, digest, authorization string) ([]byte, error) {
+	client, err := httpClient(image.Registry.TLS)
+	if err != nil {
+		return nil, err
+	}
+	url := image.URL("blobs/" + digest)
+	header := http.Header{}
+	if authorization != "" {
+		header.Set("Authorization", authorization)
+	}
+	resp, body, err := httpDo(client, "GET", url, header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s\n%s", url, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf(
+			"GET %s\nResponse code not 200, got: %d\n%s",
+			url,
+			resp.StatusCode,
+			dockerRegistryErrors(body),
+		)
+	}
+	return body, nil
+}
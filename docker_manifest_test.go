@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDockerValidateManifest(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		expect      string
+		err         string
+	}{
+		// Schema 1
+		{
+			contentType: "application/vnd.docker.distribution.manifest.v1+prettyjws",
+			body:        `{"schemaVersion": 1, "name": "library/hello-world", "tag": "latest"}`,
+			expect:      dockerMediaTypeManifestV1Signed,
+		},
+		{
+			contentType: "application/json; charset=utf-8",
+			body:        `{"schemaVersion": 1, "name": "library/hello-world", "tag": "latest"}`,
+			expect:      dockerMediaTypeManifestV1,
+		},
+		{
+			contentType: "application/vnd.docker.distribution.manifest.v1+prettyjws",
+			body:        `{"schemaVersion": 1}`,
+			err:         "Image name/tag invalid (name: '', tag: '')",
+		},
+		// Schema 2
+		{
+			contentType: "application/vnd.docker.distribution.manifest.v2+json",
+			body:        `{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json", "config": {"digest": "sha256:abc"}, "layers": []}`,
+			expect:      dockerMediaTypeManifestV2,
+		},
+		{
+			contentType: "application/vnd.docker.distribution.manifest.v2+json",
+			body:        `{"schemaVersion": 2, "layers": []}`,
+			err:         "Image manifest has no config digest",
+		},
+		// OCI image manifest without mediaType field or Content-Type
+		{
+			contentType: "",
+			body:        `{"schemaVersion": 2, "config": {"digest": "sha256:abc"}, "layers": []}`,
+			expect:      dockerMediaTypeOCIManifest,
+		},
+		// Manifest list / OCI index
+		{
+			contentType: "application/vnd.docker.distribution.manifest.list.v2+json",
+			body:        `{"schemaVersion": 2, "manifests": [{"digest": "sha256:abc", "platform": {"os": "linux", "architecture": "amd64"}}]}`,
+			expect:      dockerMediaTypeManifestList,
+		},
+		{
+			contentType: "application/vnd.oci.image.index.v1+json",
+			body:        `{"schemaVersion": 2, "manifests": []}`,
+			err:         "Image index has no manifests",
+		},
+		{
+			contentType: "text/html",
+			body:        `{}`,
+			err:         "Unsupported manifest media type 'text/html'",
+		},
+	}
+	for i, test := range tests {
+		got, err := dockerValidateManifest(dockerMediaType(test.contentType), []byte(test.body))
+		if err != nil && test.err == "" {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err != nil && err.Error() != test.err {
+			t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.err, err)
+		} else if got != test.expect {
+			t.Errorf("(%d) Expected media type '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+func TestDockerCheckPlatforms(t *testing.T) {
+	index := dockerManifest{
+		MediaType: dockerMediaTypeOCIIndex,
+		Body: []byte(`{"schemaVersion": 2, "manifests": [
+			{"digest": "sha256:a", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:b", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+			{"digest": "sha256:c", "platform": {"os": "unknown", "architecture": "unknown"}}
+		]}`),
+	}
+	image := dockerImage{Repository: "index.docker.io", Name: "library/hello-world", Tag: "latest"}
+	tests := []struct {
+		platforms []string
+		err       string
+	}{
+		{
+			platforms: []string{"linux/amd64", "linux/arm64"},
+		},
+		{
+			platforms: []string{"linux/arm64/v8"},
+		},
+		{
+			platforms: []string{"linux/amd64", "linux/arm/v7", "windows/amd64"},
+			err:       "Docker image index.docker.io/library/hello-world:latest is missing platform(s) linux/arm/v7, windows/amd64 (found: linux/amd64, linux/arm64/v8, unknown/unknown)",
+		},
+		{
+			platforms: []string{"amd64"},
+			err:       "Invalid platform 'amd64'. Expected os/arch[/variant] e.g. linux/amd64",
+		},
+	}
+	for i, test := range tests {
+		image.Platforms = test.platforms
+		err := dockerCheckPlatforms(image, index, "")
+		if err != nil && test.err == "" {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err != nil && err.Error() != test.err {
+			t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.err, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"strings"
 	"testing"
 )
@@ -23,7 +24,7 @@ func TestDockerTag(t *testing.T) {
 		},
 	}
 	for i, test := range tests {
-		tag, err := dockerTag(test.tagTemplate)
+		tag, err := dockerTag(test.tagTemplate, false)
 		if err != nil {
 			t.Errorf("(%d) Unexpected error: %s", i, err)
 		}
@@ -36,6 +37,114 @@ func TestDockerTag(t *testing.T) {
 	}
 }
 
+func TestDockerTagVars(t *testing.T) {
+	defer os.Unsetenv("CFDEPLOY_TEST_BUILD")
+	os.Setenv("CFDEPLOY_TEST_BUILD", "42") // #nosec G104
+
+	git := map[string]string{
+		"rev-parse HEAD":                          "5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20",
+		"rev-parse --short HEAD":                  "5814f5e",
+		"describe --tags --always":                "v1.2.0-3-g5814f5e",
+		"show -s --format=%ct HEAD":               "1496318400",
+		"status --porcelain --untracked-files=no": "",
+		"status --porcelain":                      "",
+	}
+	tests := []struct {
+		tagTemplate  string
+		tagged       bool
+		dirty        bool
+		untracked    bool
+		requireClean bool
+		expect       string
+		expectErrors bool
+	}{
+		{
+			tagTemplate: "{{ .GitRevFull }}",
+			expect:      "5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20",
+		},
+		{
+			tagTemplate: "{{ .GitDescribe }}",
+			expect:      "v1.2.0-3-g5814f5e",
+		},
+		{
+			tagTemplate: "{{ .GitTag | default .GitRevShort }}",
+			expect:      "5814f5e",
+		},
+		{
+			tagTemplate: "{{ .GitTag | default .GitRevShort }}",
+			tagged:      true,
+			expect:      "v1.2.0",
+		},
+		{
+			tagTemplate: "{{ .GitCommitTime.Format \"20060102150405\" }}-{{ .Env.CFDEPLOY_TEST_BUILD }}",
+			expect:      "20170601120000-42",
+		},
+		{
+			tagTemplate: "{{ .GitRevShort }}{{ if .GitDirty }}-dirty{{ end }}",
+			dirty:       true,
+			expect:      "5814f5e-dirty",
+		},
+		// Unset environment variables are errors
+		{
+			tagTemplate:  "{{ .Env.CFDEPLOY_TEST_UNSET }}",
+			expectErrors: true,
+		},
+		// Git tags can't be used with uncommitted changes if requireClean
+		// is set, but other tags can
+		{
+			tagTemplate:  "{{ .GitRevShort }}",
+			dirty:        true,
+			requireClean: true,
+			expectErrors: true,
+		},
+		{
+			tagTemplate:  "build-{{ .Env.CFDEPLOY_TEST_BUILD }}",
+			dirty:        true,
+			requireClean: true,
+			expect:       "build-42",
+		},
+		// Untracked files count as changes for requireClean, but not
+		// GitDirty
+		{
+			tagTemplate:  "{{ .GitRevShort }}",
+			untracked:    true,
+			requireClean: true,
+			expectErrors: true,
+		},
+		{
+			tagTemplate: "{{ .GitRevShort }}{{ if .GitDirty }}-dirty{{ end }}",
+			untracked:   true,
+			expect:      "5814f5e",
+		},
+	}
+	for i, test := range tests {
+		outputs := map[string]string{}
+		for args, out := range git {
+			outputs[args] = out
+		}
+		if test.tagged {
+			outputs["describe --tags --exact-match HEAD"] = "v1.2.0"
+		}
+		if test.dirty {
+			outputs["status --porcelain --untracked-files=no"] = " M main.go"
+			outputs["status --porcelain"] = " M main.go"
+		}
+		if test.untracked {
+			outputs["status --porcelain"] = "?? handler.go"
+		}
+		restore := gitStub(outputs)
+		tag, err := dockerTag(test.tagTemplate, test.requireClean)
+		restore()
+		if err != nil && !test.expectErrors {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.expectErrors {
+			t.Errorf("(%d) Expected error but no error occurred", i)
+		} else if tag != test.expect {
+			t.Errorf("(%d) Expected tag '%s', got '%s'", i, test.expect, tag)
+		}
+	}
+}
+
 func TestDockerImageList(t *testing.T) {
 	if !integration {
 		t.Skip("Skipping docker registry integration test")
@@ -140,7 +249,7 @@ func TestDockerCheckImage(t *testing.T) {
 		},
 	}
 	for i, test := range tests {
-		e := dockerCheckImage(test.image)
+		_, e := dockerCheckImage(test.image)
 		if e != nil && test.err == "" {
 			t.Errorf("(%d) Unexpected error: %s", i, e)
 		} else if e == nil && test.err != "" {
@@ -150,3 +259,67 @@ func TestDockerCheckImage(t *testing.T) {
 		}
 	}
 }
+
+func TestDockerImageListDigest(t *testing.T) {
+	yes, no := true, false
+	c := config{
+		Image: configImage{
+			Repository:  "index.docker.io",
+			TagTemplate: "latest",
+			Digest:      &yes,
+		},
+		Environments: map[string]configEnvironment{
+			"prod": configEnvironment{
+				Images: map[string]configImage{
+					"pinned": configImage{
+						Name: "library/hello-world",
+					},
+					"unpinned": configImage{
+						Name:   "library/busybox",
+						Digest: &no,
+					},
+				},
+			},
+		},
+	}
+	images, err := dockerImageList(c, "prod")
+	if err != nil {
+		t.Fatalf("Unexpected error getting Docker image list: %s", err)
+	}
+	digest := "sha256:0256e8a36e2070f7bf2d0b0763dbabdd67798512411de4cdcf9431a1feb60fd9"
+	tests := []struct {
+		key    string
+		expect string
+	}{
+		{key: "pinned", expect: "index.docker.io/library/hello-world@" + digest},
+		{key: "unpinned", expect: "index.docker.io/library/busybox:latest"},
+	}
+	for i, test := range tests {
+		image := images[test.key]
+		image.Digest = digest
+		if got := image.Reference(); got != test.expect {
+			t.Errorf("(%d) Expected reference '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+func TestDockerCheckImages(t *testing.T) {
+	images := map[string]dockerImage{
+		"a": dockerImage{},
+		"b": dockerImage{Repository: "index.docker.io"},
+		"c": dockerImage{Repository: "index.docker.io", Name: "library/hello-world"},
+	}
+	expect := "3 of 3 docker images could not be verified:\n" +
+		"* a: Image repository cannot be blank\n" +
+		"* b: Image name cannot be blank\n" +
+		"* c: Image tag cannot be blank"
+	for _, concurrency := range []int{0, 1, 2, 10} {
+		digests, err := dockerCheckImages(images, concurrency)
+		if err == nil || err.Error() != expect {
+			t.Errorf("(%d) Expected error '%s' but got '%v'", concurrency, expect, err)
+		}
+		if len(digests) != 0 {
+			t.Errorf("(%d) Expected no digests, got %v", concurrency, digests)
+		}
+	}
+}
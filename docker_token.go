@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerTokenDefaultExpiry is how long a token is valid for if the token
+// server doesn't say (see the Docker registry token spec)
+const dockerTokenDefaultExpiry = 60 * time.Second
+
+// dockerTokenMargin is how long before it expires a token is refreshed, so
+// it doesn't expire while it is being used
+const dockerTokenMargin = 10 * time.Second
+
+// dockerToken is a registry token and the time it expires
+type dockerToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Valid returns true if the token can still be used at the given time
+func (t dockerToken) Valid(now time.Time) bool {
+	return t.Token != "" && now.Add(dockerTokenMargin).Before(t.Expires)
+}
+
+// dockerTokenExpires returns when a token expires from the expires_in
+// (seconds) and issued_at (RFC 3339) fields of a token response. Either may
+// be missing, in which case the default expiry and now are used.
+func dockerTokenExpires(expiresIn int, issuedAt string, now time.Time) time.Time {
+	expiry := dockerTokenDefaultExpiry
+	if expiresIn > 0 {
+		expiry = time.Duration(expiresIn) * time.Second
+	}
+	issued, err := time.Parse(time.RFC3339, issuedAt)
+	if err != nil || issued.After(now) {
+		// Don't trust the token server's clock to be ahead of ours
+		issued = now
+	}
+	return issued.Add(expiry)
+}
+
+// dockerTokenEntry caches the token for a single realm/service/scope
+type dockerTokenEntry struct {
+	sync.Mutex
+	token dockerToken
+}
+
+// dockerTokens caches registry tokens so images in the same repository
+// (realm/service/scope) share a token. If file is set, tokens are also
+// cached on disk so they can be reused by later runs.
+var dockerTokens struct {
+	sync.Mutex
+	entries map[string]*dockerTokenEntry
+	file    string
+}
+
+// dockerTokenFile serialises reading & writing the token cache file
+var dockerTokenFile sync.Mutex
+
+// dockerTokenKey returns the cache key of a Bearer challenge
+func dockerTokenKey(challenge dockerChallenge, creds dockerCredentials) string {
+	return strings.Join([]string{
+		challenge.Params["realm"],
+		challenge.Params["service"],
+		challenge.Params["scope"],
+		creds.Username,
+	}, "|")
+}
+
+// dockerCachedToken returns a token for a Bearer challenge, only requesting
+// a new token if there isn't a valid one cached (in memory or on disk).
+// Concurrent requests for the same key wait for the first to finish.
+func dockerCachedToken(challenge dockerChallenge, creds dockerCredentials, client *http.Client) (string, error) {
+	key := dockerTokenKey(challenge, creds)
+	dockerTokens.Lock()
+	if dockerTokens.entries == nil {
+		dockerTokens.entries = map[string]*dockerTokenEntry{}
+	}
+	entry, ok := dockerTokens.entries[key]
+	if !ok {
+		entry = &dockerTokenEntry{}
+		dockerTokens.entries[key] = entry
+	}
+	file := dockerTokens.file
+	dockerTokens.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.token.Valid(time.Now()) {
+		return entry.token.Token, nil
+	}
+
+	// Check the cache file. It's only an optimisation, so errors reading or
+	// writing it are ignored.
+	if file != "" {
+		tokens, _ := dockerLoadTokenCache(file) // #nosec G104
+		if token := tokens[key]; token.Valid(time.Now()) {
+			redactAddValue(token.Token)
+			entry.token = token
+			return token.Token, nil
+		}
+	}
+
+	token, err := dockerGetToken(challenge, creds, client)
+	if err != nil {
+		return "", err
+	}
+	redactAddValue(token.Token)
+	entry.token = token
+	if file != "" && token.Valid(time.Now()) {
+		dockerSaveTokenCache(file, key, token) // #nosec G104
+	}
+	return token.Token, nil
+}
+
+// dockerTokenCachePath returns the path of the token cache file in the
+// user's cache directory
+func dockerTokenCachePath() (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", fmt.Errorf("Could not find cache directory: $XDG_CACHE_HOME and $HOME are not set")
+		}
+		if runtime.GOOS == "darwin" {
+			dir = filepath.Join(home, "Library", "Caches")
+		} else {
+			dir = filepath.Join(home, ".cache")
+		}
+	}
+	return filepath.Join(dir, "cfdeploy", "tokens.json"), nil
+}
+
+// dockerLoadTokenCache reads the tokens in the cache file. A missing file
+// is treated as an empty cache.
+func dockerLoadTokenCache(path string) (map[string]dockerToken, error) {
+	dockerTokenFile.Lock()
+	defer dockerTokenFile.Unlock()
+	return dockerReadTokenCache(path)
+}
+
+func dockerReadTokenCache(path string) (map[string]dockerToken, error) {
+	tokens := map[string]dockerToken{}
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return tokens, err
+	}
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return map[string]dockerToken{}, fmt.Errorf("Error parsing '%s': %s", path, err)
+	}
+	return tokens, nil
+}
+
+// dockerSaveTokenCache adds a token to the cache file, dropping any expired
+// tokens. The file is only readable by the current user as the tokens are
+// credentials.
+func dockerSaveTokenCache(path, key string, token dockerToken) error {
+	dockerTokenFile.Lock()
+	defer dockerTokenFile.Unlock()
+	tokens, _ := dockerReadTokenCache(path) // #nosec G104
+	now := time.Now()
+	for k, t := range tokens {
+		if !t.Valid(now) {
+			delete(tokens, k)
+		}
+	}
+	tokens[key] = token
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file & rename, so other runs never read a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tokens")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name()) // #nosec G104
+	}
+	return err
+}
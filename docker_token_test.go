@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDockerCachedToken(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"token": "` + r.URL.Query().Get("scope") + `"}`)) // #nosec G104
+	}))
+	defer server.Close()
+
+	challenge := func(scope string) dockerChallenge {
+		return dockerChallenge{Scheme: "Bearer", Params: map[string]string{
+			"realm":   server.URL + "/token",
+			"service": "registry.example.com",
+			"scope":   scope,
+		}}
+	}
+
+	// Concurrent requests for the same scope share a token
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := dockerCachedToken(challenge("repository:a:pull"), dockerCredentials{}, http.DefaultClient)
+			if err != nil || token != "repository:a:pull" {
+				t.Errorf("Unexpected token '%s' (error: %v)", token, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 token request, got %d", n)
+	}
+
+	// Different scope requires a new token
+	token, err := dockerCachedToken(challenge("repository:b:pull"), dockerCredentials{}, http.DefaultClient)
+	if err != nil || token != "repository:b:pull" {
+		t.Errorf("Unexpected token '%s' (error: %v)", token, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 token requests, got %d", n)
+	}
+}
+
+func TestDockerTokenExpires(t *testing.T) {
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expiresIn int
+		issuedAt  string
+		expect    time.Time
+	}{
+		{expiresIn: 300, issuedAt: "2018-01-01T11:59:00Z", expect: now.Add(4 * time.Minute)},
+		{expiresIn: 300, expect: now.Add(5 * time.Minute)},
+		// Default expiry
+		{issuedAt: "2018-01-01T12:00:00Z", expect: now.Add(time.Minute)},
+		{issuedAt: "invalid", expect: now.Add(time.Minute)},
+		// Issued in the future
+		{expiresIn: 60, issuedAt: "2018-01-01T13:00:00Z", expect: now.Add(time.Minute)},
+	}
+	for i, test := range tests {
+		got := dockerTokenExpires(test.expiresIn, test.issuedAt, now)
+		if !got.Equal(test.expect) {
+			t.Errorf("(%d) Expected %s, got %s", i, test.expect, got)
+		}
+	}
+}
+
+func TestDockerCachedTokenExpiry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Write([]byte(fmt.Sprintf(`{"token": "%d", "expires_in": %s}`, n, r.URL.Query().Get("scope")))) // #nosec G104
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cfdeploy", "tokens.json")
+	dockerTokens.Lock()
+	dockerTokens.file = file
+	dockerTokens.Unlock()
+	defer func() {
+		dockerTokens.Lock()
+		dockerTokens.file = ""
+		dockerTokens.Unlock()
+	}()
+
+	challenge := func(scope string) dockerChallenge {
+		return dockerChallenge{Scheme: "Bearer", Params: map[string]string{
+			"realm": server.URL + "/token",
+			"scope": scope,
+		}}
+	}
+	tests := []struct {
+		scope  string
+		expect string
+		clear  bool
+	}{
+		// Tokens about to expire aren't reused
+		{scope: "5", expect: "1"},
+		{scope: "5", expect: "2"},
+		// Valid tokens are reused, from memory or from disk
+		{scope: "300", expect: "3"},
+		{scope: "300", expect: "3"},
+		{scope: "300", expect: "3", clear: true},
+	}
+	for i, test := range tests {
+		if test.clear {
+			dockerTokens.Lock()
+			dockerTokens.entries = nil
+			dockerTokens.Unlock()
+		}
+		token, err := dockerCachedToken(challenge(test.scope), dockerCredentials{}, http.DefaultClient)
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if token != test.expect {
+			t.Errorf("(%d) Expected token '%s', got '%s'", i, test.expect, token)
+		}
+	}
+
+	// Expired tokens aren't saved, and the file is private
+	tokens, err := dockerLoadTokenCache(file)
+	if err != nil {
+		t.Fatalf("Unexpected error loading token cache: %s", err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("Expected 1 cached token, got %d", len(tokens))
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected token cache mode 0600, got %o", mode)
+	}
+}
@@ -2,15 +2,43 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
 	"text/template"
 )
 
 type fileVars struct {
-	Images map[string]string
+	gitVars // GitBranch, GitRevFull etc.
+
+	Images  map[string]string
+	Digests map[string]string
+	Vars    map[string]interface{} // environments.<env>.vars, -values & -set
+
+	// Deployment metadata
+	Environment string
+	User        string // the deploying user
+	Time        string // when the file was rendered (RFC 3339, UTC)
 }
 
-func fileLoad(path string, vars fileVars) ([]byte, error) {
+// fileUser returns the deploying user: $CFDEPLOY_USER (e.g. set by CI to the
+// person who triggered the job), or else the current user
+func fileUser() string {
+	if name := os.Getenv("CFDEPLOY_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// fileLoad renders a Marathon file with vars. Partials are loaded from
+// partialsDir (see fileLoadPartials).
+func fileLoad(path, configDir, partialsDir string, vars fileVars) ([]byte, error) {
 
 	// Read file
 	data, err := ioutil.ReadFile(path) // #nosec G304
@@ -18,8 +46,13 @@ func fileLoad(path string, vars fileVars) ([]byte, error) {
 		return nil, err
 	}
 
-	// Create template from file
-	tpl, err := template.New("file").Parse(string(data))
+	// Create template from file & partials
+	tpl := fileTemplate(filepath.Base(path))
+	err = fileLoadPartials(tpl, configDir, partialsDir)
+	if err != nil {
+		return nil, err
+	}
+	tpl, err = tpl.Parse(string(data))
 	if err != nil {
 		return nil, err
 	}
@@ -33,3 +66,42 @@ func fileLoad(path string, vars fileVars) ([]byte, error) {
 	return buf.Bytes(), nil
 
 }
+
+// fileTemplate creates a template with the functions of fileFuncs. Errors
+// give the template name & position, and referencing a missing image (e.g.
+// .Images.typo or index .Images "typo") is an error.
+func fileTemplate(name string) *template.Template {
+	return template.New(name).Option("missingkey=error").Funcs(fileFuncs())
+}
+
+// fileIndex is the template index function, except a missing map key is an
+// error rather than the zero value
+func fileIndex(item interface{}, keys ...interface{}) (interface{}, error) {
+	v := reflect.ValueOf(item)
+	for _, key := range keys {
+		switch v.Kind() {
+		case reflect.Map:
+			k := reflect.ValueOf(key)
+			if !k.IsValid() || !k.Type().AssignableTo(v.Type().Key()) {
+				return nil, fmt.Errorf("index of map with key %v of wrong type", key)
+			}
+			value := v.MapIndex(k)
+			if !value.IsValid() {
+				return nil, fmt.Errorf("map has no entry for key %q", fmt.Sprint(key))
+			}
+			v = value
+		case reflect.Slice, reflect.Array, reflect.String:
+			i, ok := key.(int)
+			if !ok {
+				return nil, fmt.Errorf("index of %s with non-int key %v", v.Kind(), key)
+			}
+			if i < 0 || i >= v.Len() {
+				return nil, fmt.Errorf("index %d out of range (length %d)", i, v.Len())
+			}
+			v = v.Index(i)
+		default:
+			return nil, fmt.Errorf("can't index item of type %s", v.Kind())
+		}
+	}
+	return v.Interface(), nil
+}
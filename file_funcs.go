@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileFuncs returns the functions available in Marathon files, in addition
+// to the text/template builtins. As in Sprig (which Helm uses), the value
+// being operated on is the last argument, so functions can be used in
+// pipelines e.g. {{ env "NAME" | default "web" | upper }}. Templates use
+// missingkey=error, so a missing map key fails before default is called;
+// test optional keys with hasKey.
+func fileFuncs() template.FuncMap {
+	return template.FuncMap{
+		"index": fileIndex,
+
+		// Strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       fileJoin,
+		"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+		"trunc":      fileTrunc,
+		"quote":      func(v interface{}) string { return strconv.Quote(fmt.Sprint(v)) },
+		"squote":     func(v interface{}) string { return "'" + fmt.Sprint(v) + "'" },
+		"indent":     fileIndent,
+		"nindent":    func(n int, s string) string { return "\n" + fileIndent(n, s) },
+
+		// Defaults
+		"default":  fileDefault,
+		"empty":    fileEmpty,
+		"coalesce": fileCoalesce,
+		"required": fileRequired,
+		"ternary":  fileTernary,
+
+		// Encoding
+		"toJson": fileToJSON,
+		"toYaml": fileToYAML,
+		"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": fileB64Decode,
+
+		// Environment
+		"env": fileEnv,
+
+		// Math
+		"add": func(a, b interface{}) (int64, error) { return fileMath("add", a, b) },
+		"sub": func(a, b interface{}) (int64, error) { return fileMath("sub", a, b) },
+		"mul": func(a, b interface{}) (int64, error) { return fileMath("mul", a, b) },
+		"div": func(a, b interface{}) (int64, error) { return fileMath("div", a, b) },
+		"mod": func(a, b interface{}) (int64, error) { return fileMath("mod", a, b) },
+		"max": func(a, b interface{}) (int64, error) { return fileMath("max", a, b) },
+		"min": func(a, b interface{}) (int64, error) { return fileMath("min", a, b) },
+
+		// Float math
+		"addf": func(a, b interface{}) (float64, error) { return fileMathFloat("addf", a, b) },
+		"subf": func(a, b interface{}) (float64, error) { return fileMathFloat("subf", a, b) },
+		"mulf": func(a, b interface{}) (float64, error) { return fileMathFloat("mulf", a, b) },
+		"divf": func(a, b interface{}) (float64, error) { return fileMathFloat("divf", a, b) },
+		"maxf": func(a, b interface{}) (float64, error) { return fileMathFloat("maxf", a, b) },
+		"minf": func(a, b interface{}) (float64, error) { return fileMathFloat("minf", a, b) },
+
+		// Lists & dicts
+		"list":   func(items ...interface{}) []interface{} { return items },
+		"first":  fileFirst,
+		"last":   fileLast,
+		"has":    fileHas,
+		"dict":   fileDict,
+		"keys":   fileKeys,
+		"hasKey": fileHasKey,
+	}
+}
+
+// fileJoin joins a list of any type e.g. {{ list "a" "b" | join "," }}
+func fileJoin(sep string, list interface{}) (string, error) {
+	items, err := fileList(list)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = fmt.Sprint(item)
+	}
+	return strings.Join(strs, sep), nil
+}
+
+// fileTrunc truncates s to at most n characters
+func fileTrunc(n int, s string) string {
+	runes := []rune(s)
+	if n >= 0 && n < len(runes) {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// fileIndent indents every line of s by n spaces
+func fileIndent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// fileDefault returns def if value is empty
+func fileDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || fileEmpty(value[0]) {
+		return def
+	}
+	return value[0]
+}
+
+// fileEmpty returns true for nil, zero values & empty collections
+func fileEmpty(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(value, reflect.Zero(v.Type()).Interface())
+}
+
+// fileCoalesce returns the first non-empty value
+func fileCoalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !fileEmpty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+// fileRequired fails rendering with message if value is empty
+func fileRequired(message string, value interface{}) (interface{}, error) {
+	if fileEmpty(value) {
+		return nil, fmt.Errorf("%s", message)
+	}
+	return value, nil
+}
+
+// fileTernary returns a if condition is true, otherwise b
+func fileTernary(a, b interface{}, condition bool) interface{} {
+	if condition {
+		return a
+	}
+	return b
+}
+
+func fileToJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// fileToYAML formats value as YAML, without a trailing newline, so it can be
+// piped to nindent
+func fileToYAML(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func fileB64Decode(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// fileEnv returns an environment variable, or "" if it isn't set. Secret
+// values (e.g. of MARATHON_TOKEN) are hidden in output.
+func fileEnv(name string) string {
+	value := os.Getenv(name)
+	if redactKey(name) {
+		redactAddValue(value)
+	}
+	return value
+}
+
+// fileMath applies an integer operation. Arguments can be any number, or a
+// string containing an integer.
+func fileMath(op string, a, b interface{}) (int64, error) {
+	x, err := fileInt(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := fileInt(b)
+	if err != nil {
+		return 0, err
+	}
+	switch op {
+	case "add":
+		return x + y, nil
+	case "sub":
+		return x - y, nil
+	case "mul":
+		return x * y, nil
+	case "div", "mod":
+		if y == 0 {
+			return 0, fmt.Errorf("%s by zero", op)
+		}
+		if op == "div" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "max":
+		if y > x {
+			return y, nil
+		}
+		return x, nil
+	case "min":
+		if y < x {
+			return y, nil
+		}
+		return x, nil
+	}
+	return 0, fmt.Errorf("Unknown operation %s", op)
+}
+
+// fileMathFloat applies a float operation (e.g. to cpus). Arguments can be
+// any number, or a string containing a number.
+func fileMathFloat(op string, a, b interface{}) (float64, error) {
+	x, err := fileFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := fileFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	switch op {
+	case "addf":
+		return x + y, nil
+	case "subf":
+		return x - y, nil
+	case "mulf":
+		return x * y, nil
+	case "divf":
+		if y == 0 {
+			return 0, fmt.Errorf("%s by zero", op)
+		}
+		return x / y, nil
+	case "maxf":
+		return math.Max(x, y), nil
+	case "minf":
+		return math.Min(x, y), nil
+	}
+	return 0, fmt.Errorf("Unknown operation %s", op)
+}
+
+// fileInt converts a number or numeric string to an int64. Floats with a
+// fraction are an error rather than being truncated (use the float functions).
+func fileInt(value interface{}) (int64, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is not an integer, use the float math functions e.g. mulf", value)
+		}
+		return int64(f), nil
+	case reflect.String:
+		return strconv.ParseInt(strings.TrimSpace(v.String()), 10, 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// fileFloat converts a number or numeric string to a float64
+func fileFloat(value interface{}) (float64, error) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return strconv.ParseFloat(strings.TrimSpace(v.String()), 64)
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+// fileList converts a slice or array of any type to a []interface{}
+func fileList(list interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%v is not a list", list)
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
+
+func fileFirst(list interface{}) (interface{}, error) {
+	items, err := fileList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+func fileLast(list interface{}) (interface{}, error) {
+	items, err := fileList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[len(items)-1], nil
+}
+
+// fileHas returns true if list contains item
+func fileHas(item, list interface{}) (bool, error) {
+	items, err := fileList(list)
+	if err != nil {
+		return false, err
+	}
+	for _, i := range items {
+		if reflect.DeepEqual(i, item) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fileDict builds a map from key & value pairs e.g. {{ dict "a" 1 "b" 2 }}
+func fileDict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict requires key & value pairs")
+	}
+	dict := map[string]interface{}{}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict key %v is not a string", pairs[i])
+		}
+		dict[key] = pairs[i+1]
+	}
+	return dict, nil
+}
+
+// fileKeys returns the sorted keys of a map
+func fileKeys(dict interface{}) ([]string, error) {
+	v := reflect.ValueOf(dict)
+	if v.Kind() != reflect.Map {
+		return nil, fmt.Errorf("%v is not a dict", dict)
+	}
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, fmt.Sprint(key.Interface()))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func fileHasKey(dict interface{}, key string) (bool, error) {
+	v := reflect.ValueOf(dict)
+	if v.Kind() != reflect.Map {
+		return false, fmt.Errorf("%v is not a dict", dict)
+	}
+	if v.Type().Key().Kind() != reflect.String {
+		return false, nil
+	}
+	return v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).IsValid(), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// filePartialsDir is the default directory of partials, relative to the
+// config file
+const filePartialsDir = "partials"
+
+// fileIncluder implements the include function of a Marathon file, which
+// renders a partial e.g. {{ include "partials/healthcheck.yaml" . }}
+type fileIncluder struct {
+	tpl       *template.Template
+	configDir string
+	dir       string   // partials directory
+	stack     []string // partials being included, to detect cycles
+}
+
+// fileLoadPartials parses every file in the partials directory (if it
+// exists) into tpl, named by its path relative to the config directory e.g.
+// "partials/healthcheck.yaml". So partials can be rendered with include or
+// template, and their {{ define }}s can be used by any template. The
+// include function is added to tpl, so must be called before tpl is parsed.
+func fileLoadPartials(tpl *template.Template, configDir, dir string) error {
+	includer := &fileIncluder{tpl: tpl, configDir: configDir, dir: dir}
+	tpl.Funcs(template.FuncMap{"include": includer.include})
+	if dir == "" {
+		return nil
+	}
+	// Walk doesn't follow symlinks, so resolve dir in case it is one
+	root, err := filepath.EvalSymlinks(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Hidden files & directories (e.g. .git) are skipped, and symlinks
+		// within dir aren't followed so partials can't be outside dir
+		hidden := strings.HasPrefix(info.Name(), ".") && file != root
+		if info.IsDir() && hidden {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || hidden {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file) // #nosec G304
+		if err != nil {
+			return err
+		}
+		// Name partials by their path under dir, not the resolved root
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		_, err = tpl.New(includer.name(filepath.Join(dir, rel))).Parse(string(data))
+		return err
+	})
+}
+
+// name returns the name of a partial file, relative to the config directory
+func (i *fileIncluder) name(file string) string {
+	if rel, err := filepath.Rel(i.configDir, file); err == nil {
+		file = rel
+	}
+	return filepath.ToSlash(file)
+}
+
+// include renders a partial with data, failing if the partial isn't in the
+// partials directory or includes itself
+func (i *fileIncluder) include(name string, data interface{}) (string, error) {
+	name = path.Clean(filepath.ToSlash(name))
+	dir := i.name(i.dir)
+	if path.IsAbs(name) || !strings.HasPrefix(name, dir+"/") {
+		return "", fmt.Errorf("Partial %s must be in the partials directory %s", name, dir)
+	}
+	for _, included := range i.stack {
+		if included == name {
+			return "", fmt.Errorf("Partial %s includes itself: %s -> %s", name, strings.Join(i.stack, " -> "), name)
+		}
+	}
+	partial := i.tpl.Lookup(name)
+	if partial == nil {
+		return "", fmt.Errorf("Partial %s not found", name)
+	}
+	i.stack = append(i.stack, name)
+	defer func() { i.stack = i.stack[:len(i.stack)-1] }()
+	var buf bytes.Buffer
+	err := partial.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
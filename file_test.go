@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // #nosec G104
+
+	vars := fileVars{
+		Images: map[string]string{"web": "registry.example.com/web:1"},
+		Vars:   map[string]interface{}{"instances": 3, "app": map[string]interface{}{"cpus": 0.5}},
+	}
+	tests := []struct {
+		data   string
+		expect string
+		err    string
+	}{
+		{
+			data:   "image: {{ .Images.web }}",
+			expect: "image: registry.example.com/web:1",
+		},
+		{
+			data:   `image: {{ index .Images "web" }}`,
+			expect: "image: registry.example.com/web:1",
+		},
+		{
+			data:   "instances: {{ .Vars.instances }}\ncpus: {{ .Vars.app.cpus }}",
+			expect: "instances: 3\ncpus: 0.5",
+		},
+		// Missing images are errors, giving the position
+		{
+			data: "id: /web\nimage: {{ .Images.wbe }}",
+			err:  `template: marathon.yaml:2:17: executing "marathon.yaml" at <.Images.wbe>: map has no entry for key "wbe"`,
+		},
+		{
+			data: `image: {{ index .Images "wbe" }}`,
+			err:  `template: marathon.yaml:1:10: executing "marathon.yaml" at <index .Images "wbe">: error calling index: map has no entry for key "wbe"`,
+		},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "marathon.yaml")
+		err := ioutil.WriteFile(path, []byte(test.data), 0600)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error writing file: %s", i, err)
+		}
+		data, err := fileLoad(path, dir, "", vars)
+		if err != nil && err.Error() != test.err {
+			t.Errorf("(%d) Expected error '%s', got '%s'", i, test.err, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if string(data) != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, data)
+		}
+	}
+}
+
+func TestFileFuncs(t *testing.T) {
+	err := os.Setenv("CFDEPLOY_TEST_REGION", "eu")
+	if err != nil {
+		t.Fatalf("Unexpected error setting env: %s", err)
+	}
+	defer os.Unsetenv("CFDEPLOY_TEST_REGION") // #nosec G104
+
+	vars := fileVars{
+		Images: map[string]string{"web": "registry.example.com/web:1"},
+		Vars:   map[string]interface{}{"name": "api"},
+	}
+	tests := []struct {
+		template string
+		expect   string
+		err      string
+	}{
+		{template: `{{ "Web" | upper }} {{ "Web" | lower }} {{ "web app" | title }}`, expect: "WEB web Web App"},
+		{template: `{{ "  web " | trim | quote }} {{ "web" | squote }}`, expect: `"web" 'web'`},
+		{template: `{{ "web-prod" | trimSuffix "-prod" | trimPrefix "w" }}`, expect: "eb"},
+		{template: `{{ "a.b.c" | replace "." "-" }} {{ "abcdef" | trunc 3 }} {{ "ab" | repeat 2 }}`, expect: "a-b-c abc abab"},
+		{template: `{{ contains "eb" "web" }} {{ hasPrefix "w" "web" }} {{ hasSuffix "x" "web" }}`, expect: "true true false"},
+		{template: `{{ split "," "a,b" | join "+" }} {{ list 1 2 3 | join "," }}`, expect: "a+b 1,2,3"},
+		{template: "a:\n{{ \"b: 1\\nc: 2\" | indent 2 }}", expect: "a:\n  b: 1\n  c: 2"},
+		{template: `a:{{ "b: 1" | nindent 2 }}`, expect: "a:\n  b: 1"},
+		{template: `{{ "" | default "web" }} {{ "api" | default "web" }} {{ 0 | default 5 }}`, expect: "web api 5"},
+		{template: `{{ coalesce "" "" "web" }} {{ empty "" }} {{ empty (list 1) }}`, expect: "web true false"},
+		{template: `{{ ternary "yes" "no" true }} {{ ternary "yes" "no" false }}`, expect: "yes no"},
+		{template: `{{ "" | required "region is required" }}`, err: "region is required"},
+		{template: `{{ dict "a" 1 "b" (list "x" "y") | toJson }}`, expect: `{"a":1,"b":["x","y"]}`},
+		{template: "{{ dict \"a\" 1 \"b\" (list \"x\") | toYaml }}", expect: "a: 1\nb:\n- x"},
+		{template: `{{ "web" | b64enc }} {{ "d2Vi" | b64dec }}`, expect: "d2Vi web"},
+		{template: `{{ env "CFDEPLOY_TEST_REGION" }}-{{ env "CFDEPLOY_TEST_UNSET" }}`, expect: "eu-"},
+		{template: `{{ add 1 2 }} {{ sub 5 "2" }} {{ mul 2 3 }} {{ div 7 2 }} {{ mod 7 2 }} {{ max 1 3 }} {{ min 1 3 }}`, expect: "3 3 6 3 1 3 1"},
+		{template: `{{ div 1 0 }}`, err: "div by zero"},
+		{template: `{{ mul 0.5 2 }}`, err: "0.5 is not an integer, use the float math functions e.g. mulf"},
+		{template: `{{ mul 2.0 3 }}`, expect: "6"},
+		{template: `{{ mulf 0.5 2 }} {{ addf 0.25 "0.5" }} {{ subf 1 0.25 }} {{ divf 1 4 }} {{ maxf 0.5 1 }} {{ minf 0.5 1 }}`, expect: "1 0.75 0.75 0.25 1 0.5"},
+		{template: `{{ divf 1 0 }}`, err: "divf by zero"},
+		{template: `{{ first (list 1 2) }} {{ last (list 1 2) }} {{ has 2 (list 1 2) }}`, expect: "1 2 true"},
+		{template: `{{ keys .Images | join "," }} {{ hasKey .Images "web" }} {{ hasKey .Images "api" }}`, expect: "web true false"},
+		{template: `{{ dict "a" }}`, err: "dict requires key & value pairs"},
+		// Missing keys are errors, so optional keys are tested with hasKey
+		{template: `{{ env "CFDEPLOY_TEST_UNSET" | default "web" | upper }}`, expect: "WEB"},
+		{template: `{{ index .Images "svcc" }}`, err: `map has no entry for key "svcc"`},
+		{template: `{{ .Vars.canary | default "web" }}`, err: `map has no entry for key "canary"`},
+		{template: `{{ if hasKey .Vars "canary" }}canary{{ else }}{{ .Vars.name }}{{ end }}`, expect: "api"},
+	}
+	for i, test := range tests {
+		tpl, err := fileTemplate("test").Parse(test.template)
+		if err != nil {
+			t.Errorf("(%d) Unexpected error parsing template: %s", i, err)
+			continue
+		}
+		var buf bytes.Buffer
+		err = tpl.Execute(&buf, vars)
+		if err != nil && (test.err == "" || !strings.HasSuffix(err.Error(), test.err)) {
+			t.Errorf("(%d) Expected error '%s', got '%s'", i, test.err, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err == nil && buf.String() != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, buf.String())
+		}
+	}
+}
+
+func TestFileLoadPartials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // #nosec G104
+
+	files := map[string]string{
+		"deploy.yaml":                 "environments: {}",
+		"partials/healthcheck.yaml":   "path: /health\nport: {{ .Vars.port }}",
+		"partials/docker.tpl":         `{{ define "logging" }}key: log-driver{{ end }}`,
+		"partials/loop/a.yaml":        `{{ include "partials/loop/b.yaml" . }}`,
+		"partials/loop/b.yaml":        `{{ include "partials/loop/a.yaml" . }}`,
+		"partials/nested/outer.yaml":  `outer: {{ include "partials/nested/inner.yaml" . }}`,
+		"partials/nested/inner.yaml":  `inner`,
+		"partials/.hidden/ignore.tpl": `{{ invalid`,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(data), 0600)
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", name, err)
+		}
+	}
+
+	vars := fileVars{Vars: map[string]interface{}{"port": 8080}}
+	tests := []struct {
+		data   string
+		expect string
+		err    string
+	}{
+		{
+			data:   `healthCheck: {{ include "partials/healthcheck.yaml" . | nindent 2 }}`,
+			expect: "healthCheck: \n  path: /health\n  port: 8080",
+		},
+		{
+			data:   `{{ template "logging" }} {{ template "partials/healthcheck.yaml" . }}`,
+			expect: "key: log-driver path: /health\nport: 8080",
+		},
+		{
+			data:   `{{ include "./partials/nested/outer.yaml" . }}`,
+			expect: "outer: inner",
+		},
+		{
+			data: `{{ include "partials/loop/a.yaml" . }}`,
+			err:  "Partial partials/loop/a.yaml includes itself: partials/loop/a.yaml -> partials/loop/b.yaml -> partials/loop/a.yaml",
+		},
+		{
+			data: `{{ include "partials/../deploy.yaml" . }}`,
+			err:  "Partial deploy.yaml must be in the partials directory partials",
+		},
+		{
+			data: `{{ include "/etc/passwd" . }}`,
+			err:  "Partial /etc/passwd must be in the partials directory partials",
+		},
+		{
+			data: `{{ include "partials/missing.yaml" . }}`,
+			err:  "Partial partials/missing.yaml not found",
+		},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "marathon.yaml")
+		err := ioutil.WriteFile(path, []byte(test.data), 0600)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error writing file: %s", i, err)
+		}
+		data, err := fileLoad(path, dir, filepath.Join(dir, "partials"), vars)
+		if err != nil && (test.err == "" || !strings.HasSuffix(err.Error(), test.err)) {
+			t.Errorf("(%d) Expected error '%s', got '%s'", i, test.err, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err == nil && string(data) != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, data)
+		}
+	}
+}
+
+func TestFileLoadPartialsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // #nosec G104
+
+	files := map[string]string{
+		"shared/healthcheck.yaml":  "path: /health",
+		"outside/healthcheck.yaml": "path: /outside",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(data), 0600)
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error writing %s: %s", name, err)
+		}
+	}
+	// linked/partials is a symlink to shared
+	err = os.Mkdir(filepath.Join(dir, "linked"), 0700)
+	if err == nil {
+		err = os.Symlink(filepath.Join(dir, "shared"), filepath.Join(dir, "linked", "partials"))
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error creating symlink: %s", err)
+	}
+
+	tests := []struct {
+		configDir   string
+		partialsDir string
+		data        string
+		expect      string
+		err         string
+	}{
+		// Symlinked partials directory
+		{
+			configDir:   "linked",
+			partialsDir: "linked/partials",
+			data:        `{{ include "partials/healthcheck.yaml" . }}`,
+			expect:      "path: /health",
+		},
+		{
+			configDir:   "linked",
+			partialsDir: "linked/partials",
+			data:        `{{ include "partials/../../outside/healthcheck.yaml" . }}`,
+			err:         "Partial ../outside/healthcheck.yaml must be in the partials directory partials",
+		},
+	}
+	for i, test := range tests {
+		configDir := filepath.Join(dir, test.configDir)
+		path := filepath.Join(configDir, "marathon.yaml")
+		err := ioutil.WriteFile(path, []byte(test.data), 0600)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error writing file: %s", i, err)
+		}
+		data, err := fileLoad(path, configDir, filepath.Join(dir, test.partialsDir), fileVars{})
+		if err != nil && (test.err == "" || !strings.HasSuffix(err.Error(), test.err)) {
+			t.Errorf("(%d) Expected error '%s', got '%s'", i, test.err, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err == nil && string(data) != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, data)
+		}
+	}
+}
+
+func TestFileVarsMetadata(t *testing.T) {
+	defer gitStub(map[string]string{
+		"symbolic-ref --short HEAD": "master",
+		"rev-list --count HEAD":     "93",
+		"rev-parse --short HEAD":    "5814f5e",
+		"rev-parse HEAD":            "5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20",
+	})()
+
+	vars := fileVars{Environment: "prod", User: "deployer", Time: "2017-06-01T12:00:00Z"}
+	tpl, err := fileTemplate("test").Parse(
+		"{{ .Environment }} {{ .User }} {{ .Time }} " +
+			"{{ .GitBranch }} {{ .GitRevCount }} {{ .GitRevShort }} {{ .GitRevFull }}",
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing template: %s", err)
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, vars)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expect := "prod deployer 2017-06-01T12:00:00Z master 93 5814f5e 5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20"
+	if buf.String() != expect {
+		t.Errorf("Expected '%s', got '%s'", expect, buf.String())
+	}
+}
+
+// gitStub replaces git with the given outputs (keyed by arguments),
+// returning a function which restores it
+func gitStub(outputs map[string]string) func() {
+	run := gitRun
+	gitRun = func(args ...string) ([]byte, error) {
+		out, ok := outputs[strings.Join(args, " ")]
+		if !ok {
+			return nil, fmt.Errorf("exit status 128 fatal: not a git repository")
+		}
+		return []byte(out + "\n"), nil
+	}
+	gitCache.Lock()
+	gitCache.out = nil
+	gitCache.Unlock()
+	return func() {
+		gitRun = run
+		gitCache.Lock()
+		gitCache.out = nil
+		gitCache.Unlock()
+	}
+}
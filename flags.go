@@ -6,9 +6,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type flags struct {
+	command          string
+	subcommand       string
+	args             []string
 	env              string
 	configFile       string
 	configPath       string
@@ -16,43 +20,187 @@ type flags struct {
 	marathonHost     string
 	marathonCurlOpts string
 	marathonForce    bool
+	marathonWait     bool
+	marathonTimeout  time.Duration
+	rollback         bool
+	rollbackVersion  string
+	historyLimit     int
+	diff             bool
+	checkImages      bool
+	concurrency      int
+	tokenCache       bool
+	httpRetries      int
+	httpTimeout      time.Duration
+	imageTag         string
+	values           flagsList
+	set              flagsList
+	outputFormat     string
+	outputFile       string
 	skipPrompt       bool
 	verbose          bool
 }
 
-func (f *flags) parse() (err error) {
+// parse parses the command line arguments (excluding the program name). The
+// first argument is the command name. If it is omitted (i.e. the first
+// argument is a flag) the deploy command is used.
+func (f *flags) parse(args []string) (cmd command, err error) {
+
+	// Find command
+	if len(args) == 0 {
+		commandsUsage()
+		return command{}, cmdErrorf(exitUsage, "No command given")
+	}
+	name := "deploy"
+	if !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commandFind(name)
+	if !ok {
+		commandsUsage()
+		return command{}, cmdErrorf(exitUsage, "Unknown command '%s'", name)
+	}
+	f.command = cmd.Name
+	if len(cmd.Subcommands) > 0 && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		f.subcommand, args = args[0], args[1:]
+		if !flagsContains(cmd.Subcommands, f.subcommand) {
+			return cmd, cmdErrorf(
+				exitUsage,
+				"Unknown %s subcommand '%s'. Expected: %s",
+				cmd.Name,
+				f.subcommand,
+				strings.Join(cmd.Subcommands, ", "),
+			)
+		}
+	}
 
 	// Parse flags
-	flag.StringVar(&f.env, "e", "", "Environment (e.g. \"prod\")")
-	flag.StringVar(&f.configFile, "f", "deploy.yaml", "Config File")
-	flag.StringVar(&f.marathonHost, "marathon.host", "", "Marathon Host (e.g. \"www.example.com\"")
-	flag.StringVar(&f.marathonCurlOpts, "marathon.curlopts", "", "Marathon cURL options (e.g. '-H \"OauthEmail: no-reply@cloudflare.com\"'). Note: only -H is currently supported.")
-	flag.BoolVar(&f.marathonForce, "marathon.force", false, "Add the ?force=true to the Marathon request")
-	flag.BoolVar(&f.skipPrompt, "y", false, "Skip confirmation prompt")
-	flag.BoolVar(&f.verbose, "v", false, "Verbose mode e.g. dump Marathon config")
-	flag.Parse()
+	fs := flag.NewFlagSet("cfdeploy "+cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() { commandUsage(cmd, fs) }
+	if !cmd.NoConfig {
+		fs.StringVar(&f.env, "e", "", "Environment (e.g. \"prod\")")
+		fs.StringVar(&f.configFile, "f", "deploy.yaml", "Config File")
+		fs.StringVar(&f.marathonHost, "marathon.host", "", "Marathon Host (e.g. \"www.example.com\"")
+		fs.StringVar(&f.marathonCurlOpts, "marathon.curlopts", "", "Marathon cURL options (e.g. '-H \"OauthEmail: no-reply@cloudflare.com\"'). Note: only -H is currently supported.")
+		fs.BoolVar(&f.verbose, "v", false, "Verbose mode e.g. dump Marathon config")
+		fs.IntVar(&f.concurrency, "docker.concurrency", 4, "Maximum number of Docker images to check at once")
+		fs.BoolVar(&f.tokenCache, "docker.tokencache", false, "Cache Docker registry tokens on disk so later runs can reuse them")
+		fs.IntVar(&f.httpRetries, "http.retries", httpOptions.Retries, "Number of times to retry failed Docker registry & Marathon requests")
+		fs.DurationVar(&f.httpTimeout, "http.timeout", httpOptions.Timeout, "Timeout of each Docker registry & Marathon request")
+		fs.Var(&f.values, "values", "YAML file of template vars, overriding the environment's vars (can be repeated)")
+		fs.Var(&f.set, "set", "Set a template var e.g. \"instances=3\" or \"app.cpus=0.5\", overriding -values (can be repeated)")
+	}
+	if cmd.Flags != nil {
+		cmd.Flags(fs, f)
+	}
+	err = fs.Parse(args)
+	if err == flag.ErrHelp {
+		return cmd, errHelp
+	}
+	if err != nil {
+		return cmd, cmdError{code: exitUsage, err: err}
+	}
+	f.args = fs.Args()
+	if len(cmd.Subcommands) > 0 && f.subcommand == "" {
+		fs.Usage()
+		return cmd, cmdErrorf(
+			exitUsage,
+			"The %s command requires a subcommand: %s",
+			cmd.Name,
+			strings.Join(cmd.Subcommands, ", "),
+		)
+	}
+	if cmd.NoConfig {
+		return cmd, nil
+	}
 
 	// Validate flags
 	if f.env == "" || f.configFile == "" {
-		flag.Usage()
-		os.Exit(1)
+		fs.Usage()
+		return cmd, cmdErrorf(exitUsage, "Flags -e and -f are required")
 	}
 	f.configPath, err = filepath.Abs(f.configFile)
 	if err != nil {
-		return fmt.Errorf("Error parsing config file path: %s", err)
+		return cmd, fmt.Errorf("Error parsing config file path: %s", err)
 	}
 	_, err = os.Stat(f.configPath)
 	if err != nil {
-		return fmt.Errorf("Invalid config file path '%s': %s", f.configFile, err)
+		return cmd, fmt.Errorf("Invalid config file path '%s': %s", f.configFile, err)
 	}
 	f.configDir = filepath.Dir(f.configPath)
+	if f.rollback {
+		f.marathonWait = true
+	}
+	if f.imageTag != "" && strings.ContainsAny(f.imageTag, ":{}") {
+		return cmd, cmdErrorf(exitUsage, "Image tag '%s' is invalid", f.imageTag)
+	}
+	if f.outputFormat != "json" && f.outputFormat != "yaml" && f.outputFormat != "" {
+		return cmd, cmdErrorf(exitUsage, "Output format must be json or yaml. Found: %s", f.outputFormat)
+	}
 	if f.marathonHost != "" && strings.Contains(f.marathonHost, "/") {
-		return fmt.Errorf(
+		return cmd, cmdErrorf(
+			exitUsage,
 			"Marathon hostname cannot contain forward slash. Found: %s",
 			f.marathonHost,
 		)
 	}
+	for _, set := range f.set {
+		if strings.Index(set, "=") <= 0 {
+			return cmd, cmdErrorf(exitUsage, "Invalid -set '%s'. Expected key=value", set)
+		}
+	}
+	if f.httpRetries < 0 {
+		return cmd, cmdErrorf(exitUsage, "HTTP retries cannot be negative. Found: %d", f.httpRetries)
+	}
+
+	return cmd, nil
+
+}
+
+// apply configures the HTTP & Docker token settings shared by all requests
+func (f *flags) apply() error {
+	httpOptions.Retries = f.httpRetries
+	httpOptions.Timeout = f.httpTimeout
+	if f.tokenCache {
+		file, err := dockerTokenCachePath()
+		if err != nil {
+			return err
+		}
+		dockerTokens.file = file
+	}
+	return nil
+}
+
+// flagsList is a flag which can be given more than once
+type flagsList []string
 
-	return
+func (l *flagsList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *flagsList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// flagsContains returns true if s is in list
+func flagsContains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// flagsTag registers the flag to override image tags
+func flagsTag(fs *flag.FlagSet, f *flags) {
+	fs.StringVar(&f.imageTag, "tag", "", "Use this image tag for all images instead of the tag template (e.g. \"93-5814f5e\")")
+}
 
+// flagsWait registers the flags used by commands which can wait for a
+// Marathon deployment to finish
+func flagsWait(fs *flag.FlagSet, f *flags) {
+	fs.BoolVar(&f.marathonWait, "marathon.wait", false, "Wait for the Marathon deployment to finish and all apps to be healthy")
+	fs.DurationVar(&f.marathonTimeout, "marathon.timeout", 10*time.Minute, "Maximum time to wait for the Marathon deployment (with -marathon.wait)")
+	fs.BoolVar(&f.skipPrompt, "y", false, "Skip confirmation prompt")
 }
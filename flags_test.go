@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
 )
 
 var integration bool
@@ -10,3 +13,104 @@ func init() {
 	flag.BoolVar(&integration, "integration", false, "Run integration tests")
 	flag.Parse()
 }
+
+func TestFlagsParse(t *testing.T) {
+	configFile, err := ioutil.TempFile("", "deploy.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error creating config file: %s", err)
+	}
+	defer os.Remove(configFile.Name())
+	configFile.Close() // #nosec G104
+
+	tests := []struct {
+		args         []string
+		expectCmd    string
+		expectWait   bool
+		expectExit   int
+		expectErrors bool
+	}{
+		// Alias for deploy
+		{
+			args:      []string{"-e", "prod", "-f", configFile.Name()},
+			expectCmd: "deploy",
+		},
+		{
+			args:       []string{"deploy", "-e", "prod", "-f", configFile.Name(), "-rollback-on-failure"},
+			expectCmd:  "deploy",
+			expectWait: true,
+		},
+		{
+			args:      []string{"render", "-e", "prod", "-f", configFile.Name()},
+			expectCmd: "render",
+		},
+		// Flag of another command
+		{
+			args:         []string{"render", "-e", "prod", "-f", configFile.Name(), "-y"},
+			expectErrors: true,
+			expectExit:   exitUsage,
+		},
+		// Missing environment
+		{
+			args:         []string{"status", "-f", configFile.Name()},
+			expectErrors: true,
+			expectExit:   exitUsage,
+		},
+		{
+			args:         []string{"unknown"},
+			expectErrors: true,
+			expectExit:   exitUsage,
+		},
+		{
+			args:      []string{"config", "show", "-e", "prod", "-f", configFile.Name()},
+			expectCmd: "config",
+		},
+		{
+			args:      []string{"render", "-e", "prod", "-f", configFile.Name(), "-set", "instances=3", "-set", "app.cpus=1"},
+			expectCmd: "render",
+		},
+		{
+			args:         []string{"render", "-e", "prod", "-f", configFile.Name(), "-set", "instances"},
+			expectErrors: true,
+			expectExit:   exitUsage,
+		},
+		// Missing or unknown subcommand
+		{
+			args:         []string{"config", "-e", "prod", "-f", configFile.Name()},
+			expectErrors: true,
+			expectExit:   exitUsage,
+		},
+		{
+			args:         []string{"config", "edit", "-e", "prod", "-f", configFile.Name()},
+			expectErrors: true,
+			expectExit:   exitUsage,
+		},
+		{
+			args:         []string{"history", "-h"},
+			expectErrors: true,
+			expectExit:   exitOK,
+		},
+	}
+	for i, test := range tests {
+		var f flags
+		cmd, err := f.parse(test.args)
+		if err != nil && !test.expectErrors {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+			continue
+		} else if err == nil && test.expectErrors {
+			t.Errorf("(%d) Expected error but no error occurred", i)
+			continue
+		}
+		if code := cmdExitCode(err); code != test.expectExit {
+			t.Errorf("(%d) Expected exit code %d, got %d", i, test.expectExit, code)
+		}
+		if err != nil {
+			continue
+		}
+		if cmd.Name != test.expectCmd {
+			t.Errorf("(%d) Expected command '%s', got '%s'", i, test.expectCmd, cmd.Name)
+		}
+		if f.marathonWait != test.expectWait {
+			t.Errorf("(%d) Expected marathonWait = %t, got %t", i, test.expectWait, f.marathonWait)
+		}
+	}
+}
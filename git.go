@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitRun runs git with the given arguments, returning its output (replaced
+// in tests)
+var gitRun = func(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...) // #nosec G204
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// gitCache holds the output of each git command, as git is run for both the
+// tag templates & the Marathon file
+var gitCache struct {
+	sync.Mutex
+	out map[string]string
+}
+
+// gitOutput returns the output of a git command (without surrounding
+// whitespace), running it only the first time it is needed
+func gitOutput(args ...string) (string, error) {
+	key := strings.Join(args, " ")
+	gitCache.Lock()
+	defer gitCache.Unlock()
+	if out, ok := gitCache.out[key]; ok {
+		return out, nil
+	}
+	out, err := gitRun(args...)
+	if err != nil {
+		return "", fmt.Errorf("Error running git %s: %s", key, strings.TrimSpace(err.Error()))
+	}
+	if gitCache.out == nil {
+		gitCache.out = map[string]string{}
+	}
+	gitCache.out[key] = strings.TrimSpace(string(out))
+	return gitCache.out[key], nil
+}
+
+// gitVars are the git variables of tag templates & Marathon files. They are
+// methods, so git is only run for the variables used (as git isn't always
+// available e.g. when rendering with -tag).
+type gitVars struct{}
+
+// GitBranch returns the current branch, which fails if HEAD is detached
+func (gitVars) GitBranch() (string, error) {
+	return gitOutput("symbolic-ref", "--short", "HEAD")
+}
+
+// GitRevCount returns the number of commits up to HEAD
+func (gitVars) GitRevCount() (string, error) {
+	return gitOutput("rev-list", "--count", "HEAD")
+}
+
+// GitRevShort returns the abbreviated hash of HEAD
+func (gitVars) GitRevShort() (string, error) {
+	return gitOutput("rev-parse", "--short", "HEAD")
+}
+
+// GitRevFull returns the full hash of HEAD
+func (gitVars) GitRevFull() (string, error) {
+	return gitOutput("rev-parse", "HEAD")
+}
+
+// GitDescribe returns the nearest tag, with the number of commits since it
+// and the abbreviated hash e.g. "v1.2.0-3-g5814f5e" (or just the hash if
+// there are no tags)
+func (gitVars) GitDescribe() (string, error) {
+	return gitOutput("describe", "--tags", "--always")
+}
+
+// GitTag returns the tag of HEAD, or "" if HEAD isn't tagged
+func (g gitVars) GitTag() (string, error) {
+	_, err := g.GitRevFull() // fails if this isn't a git repository
+	if err != nil {
+		return "", err
+	}
+	tag, err := gitOutput("describe", "--tags", "--exact-match", "HEAD")
+	if err != nil {
+		return "", nil
+	}
+	return tag, nil
+}
+
+// GitDirty returns true if tracked files have uncommitted changes
+func (gitVars) GitDirty() (bool, error) {
+	status, err := gitStatus()
+	return status != "", err
+}
+
+// GitCommitTime returns the commit time of HEAD, in UTC. Use Format for
+// a tag e.g. {{ .GitCommitTime.Format "20060102150405" }}.
+func (gitVars) GitCommitTime() (time.Time, error) {
+	out, err := gitOutput("show", "-s", "--format=%ct", "HEAD")
+	if err != nil {
+		return time.Time{}, err
+	}
+	seconds, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid git commit time '%s'", out)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// gitStatus returns the changed tracked files, in git's porcelain format
+func gitStatus() (string, error) {
+	return gitOutput("status", "--porcelain", "--untracked-files=no")
+}
+
+// gitCheckClean returns an error if the working tree has uncommitted
+// changes, so what (e.g. a tag template) wouldn't match the code. Unlike
+// GitDirty, untracked files (which could be built into an image) count as
+// changes, but ignored files don't.
+func gitCheckClean(what string) error {
+	status, err := gitOutput("status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if status != "" {
+		return fmt.Errorf(
+			"Refusing to use %s as the git working tree has uncommitted changes (git.requireClean is set):\n%s",
+			what,
+			status,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpOptions configure all Docker registry & Marathon requests
+var httpOptions = struct {
+	Retries       int           // retries after the first attempt
+	Timeout       time.Duration // per attempt, including reading the body
+	Backoff       time.Duration // wait before the first retry, doubled for each retry
+	MaxBackoff    time.Duration // maximum wait between attempts
+	MaxRetryAfter time.Duration // maximum Retry-After that will be honoured
+}{
+	Retries:       3,
+	Timeout:       30 * time.Second,
+	Backoff:       500 * time.Millisecond,
+	MaxBackoff:    10 * time.Second,
+	MaxRetryAfter: time.Minute,
+}
+
+// httpSleep waits between attempts (replaced in tests)
+var httpSleep = time.Sleep
+
+// httpTransports caches a transport per TLS config, so connections are
+// reused between requests
+var httpTransports struct {
+	sync.Mutex
+	transports map[configTLS]*http.Transport
+}
+
+// httpClient returns a client with the configured timeout & TLS settings
+func httpClient(t configTLS) (*http.Client, error) {
+	httpTransports.Lock()
+	defer httpTransports.Unlock()
+	transport, ok := httpTransports.transports[t]
+	if !ok {
+		tlsConfig, err := httpTLSConfig(t)
+		if err != nil {
+			return nil, err
+		}
+		// Same settings as http.DefaultTransport
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		}
+		if httpTransports.transports == nil {
+			httpTransports.transports = map[configTLS]*http.Transport{}
+		}
+		httpTransports.transports[t] = transport
+	}
+	return &http.Client{Transport: transport, Timeout: httpOptions.Timeout}, nil
+}
+
+// httpTLSConfig builds the TLS config of a client. A CA file is trusted in
+// addition to the system's CAs.
+func httpTLSConfig(t configTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify, // #nosec G402
+	}
+	if t.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(t.CAFile) // #nosec G304
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No PEM certificates found in CA file '%s'", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// httpDo sends a request, retrying transient failures, and returns the
+// response along with its body (which has already been read & closed).
+//
+// GET & HEAD requests are retried after network errors and 408, 429, 500,
+// 502, 503 & 504 responses. Other methods are only retried if the request
+// couldn't be sent at all (e.g. connection refused), as a failed response
+// may not mean the change wasn't made. If retries run out, the last response
+// is returned so the caller can report it.
+func httpDo(client *http.Client, method, url string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	idempotent := method == "GET" || method == "HEAD"
+	for attempt := 0; ; attempt++ {
+		resp, respBody, err := httpAttempt(client, method, url, header, body)
+		retry := attempt < httpOptions.Retries
+		wait := httpBackoff(attempt)
+		if err != nil {
+			retry = retry && (idempotent || httpNotSent(err))
+			if !retry {
+				return nil, nil, err
+			}
+			log.Printf("%s %s failed, retrying in %s: %s", method, url, wait, err)
+		} else {
+			retry = retry && idempotent && httpRetryStatus(resp.StatusCode)
+			if !retry {
+				return resp, respBody, nil
+			}
+			if retryAfter, ok := httpRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				wait = retryAfter
+			}
+			log.Printf("%s %s failed, retrying in %s: %s", method, url, wait, resp.Status)
+		}
+		httpSleep(wait)
+	}
+}
+
+// httpAttempt sends a request once
+func httpAttempt(client *http.Client, method, url string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	// The body is rebuilt for each attempt as sending it consumes it
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error building request: %s", err)
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close() // #nosec G104
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading response: %s", err)
+	}
+	return resp, respBody, nil
+}
+
+// httpNotSent returns true if a request failed before it was sent, so it is
+// safe to retry whatever the method
+func httpNotSent(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// httpRetryStatus returns true for response codes which are usually
+// transient (e.g. a load balancer without a healthy backend)
+func httpRetryStatus(code int) bool {
+	switch code {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// httpBackoff returns how long to wait before retrying an attempt (counted
+// from 0). The wait doubles for each attempt (up to the maximum), and is
+// jittered so concurrent requests don't retry in lockstep.
+func httpBackoff(attempt int) time.Duration {
+	wait := httpOptions.Backoff
+	for i := 0; i < attempt && wait < httpOptions.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > httpOptions.MaxBackoff {
+		wait = httpOptions.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	// Wait between half and all of the backoff
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1)) // #nosec G404
+}
+
+// httpRetryAfter parses a Retry-After header, which is either a number of
+// seconds or a HTTP date. Waits longer than the maximum aren't honoured.
+func httpRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = date.Sub(now)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > httpOptions.MaxRetryAfter {
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPDo(t *testing.T) {
+	// Record waits rather than sleeping
+	var waits []time.Duration
+	defer func(sleep func(time.Duration)) { httpSleep = sleep }(httpSleep)
+	httpSleep = func(d time.Duration) { waits = append(waits, d) }
+
+	// Closed server, so connections are refused
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		method     string
+		statuses   []int  // response status of each attempt
+		retryAfter string // Retry-After header of failed attempts
+		url        string
+		expect     int // final status
+		wait       time.Duration
+		attempts   int32
+		err        bool
+	}{
+		// Success
+		{method: "GET", statuses: []int{200}, expect: 200, attempts: 1},
+		// Transient failures are retried
+		{method: "GET", statuses: []int{502, 503, 200}, expect: 200, attempts: 3},
+		// Retries run out
+		{method: "GET", statuses: []int{502, 502, 502, 502, 200}, expect: 502, attempts: 4},
+		// Retry-After is honoured
+		{method: "GET", statuses: []int{429, 200}, retryAfter: "2", expect: 200, attempts: 2, wait: 2 * time.Second},
+		// Client errors aren't retried
+		{method: "HEAD", statuses: []int{404, 200}, expect: 404, attempts: 1},
+		// PUTs aren't retried once a response was received
+		{method: "PUT", statuses: []int{502, 200}, expect: 502, attempts: 1},
+		// ...but are when the connection is refused
+		{method: "PUT", url: closed.URL, err: true},
+	}
+	for i, test := range tests {
+		waits = nil
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&attempts, 1)
+			if test.retryAfter != "" {
+				w.Header().Set("Retry-After", test.retryAfter)
+			}
+			w.WriteHeader(test.statuses[n-1])
+			fmt.Fprintf(w, "attempt %d", n) // #nosec G104
+		}))
+		url := server.URL
+		if test.url != "" {
+			url = test.url
+		}
+		resp, _, err := httpDo(http.DefaultClient, test.method, url, nil, []byte("{}"))
+		server.Close()
+		if err != nil && !test.err {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+			continue
+		} else if err == nil && test.err {
+			t.Errorf("(%d) Expected error but no error occurred", i)
+			continue
+		}
+		if err == nil && resp.StatusCode != test.expect {
+			t.Errorf("(%d) Expected status %d, got %d", i, test.expect, resp.StatusCode)
+		}
+		if attempts != test.attempts {
+			t.Errorf("(%d) Expected %d attempts, got %d", i, test.attempts, attempts)
+		}
+		expectWaits := int(test.attempts) - 1
+		if test.err {
+			expectWaits = httpOptions.Retries
+		}
+		if expectWaits < 0 {
+			expectWaits = 0
+		}
+		if len(waits) != expectWaits {
+			t.Errorf("(%d) Expected %d retries, got %d", i, expectWaits, len(waits))
+		} else if test.wait != 0 && waits[0] != test.wait {
+			t.Errorf("(%d) Expected to wait %s, got %s", i, test.wait, waits[0])
+		}
+	}
+}
+
+func TestHTTPRetryAfter(t *testing.T) {
+	now := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		expect time.Duration
+		ok     bool
+	}{
+		{header: "", ok: false},
+		{header: "5", expect: 5 * time.Second, ok: true},
+		{header: "Mon, 01 Jan 2018 12:00:30 GMT", expect: 30 * time.Second, ok: true},
+		{header: "Mon, 01 Jan 2018 11:00:00 GMT", expect: 0, ok: true},
+		// Too long to wait
+		{header: "3600", ok: false},
+		{header: "soon", ok: false},
+	}
+	for i, test := range tests {
+		got, ok := httpRetryAfter(test.header, now)
+		if ok != test.ok || got != test.expect {
+			t.Errorf("(%d) Expected %s (%t), got %s (%t)", i, test.expect, test.ok, got, ok)
+		}
+	}
+}
+
+func TestHTTPBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		max := httpOptions.Backoff << uint(attempt)
+		if max > httpOptions.MaxBackoff || max <= 0 {
+			max = httpOptions.MaxBackoff
+		}
+		got := httpBackoff(attempt)
+		if got < max/2 || got > max {
+			t.Errorf("(%d) Expected backoff between %s and %s, got %s", attempt, max/2, max, got)
+		}
+	}
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Trust the test server's certificate
+	dir, err := ioutil.TempDir("", "cfdeploy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+	err = ioutil.WriteFile(caFile, ca, 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error writing CA file: %s", err)
+	}
+	notPEM := filepath.Join(dir, "ca.txt")
+	err = ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error writing CA file: %s", err)
+	}
+
+	tests := []struct {
+		tls        configTLS
+		clientErr  string
+		requestErr bool
+	}{
+		{tls: configTLS{}, requestErr: true},
+		{tls: configTLS{CAFile: caFile}},
+		{tls: configTLS{InsecureSkipVerify: true}},
+		{tls: configTLS{CAFile: caFile, ServerName: "marathon.internal"}, requestErr: true},
+		{tls: configTLS{CAFile: notPEM}, clientErr: "No PEM certificates found in CA file '" + notPEM + "'"},
+	}
+	for i, test := range tests {
+		client, err := httpClient(test.tls)
+		if err != nil {
+			if err.Error() != test.clientErr {
+				t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.clientErr, err)
+			}
+			continue
+		} else if test.clientErr != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.clientErr)
+			continue
+		}
+		_, err = client.Get(server.URL)
+		if err != nil && !test.requestErr {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.requestErr {
+			t.Errorf("(%d) Expected error but no error occurred", i)
+		}
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -104,15 +103,15 @@ type marathonResult struct {
 }
 
 // marathonPrepare will read a YAML file, validate it and return a JSON
-func marathonPrepare(f flags, conf config, vars fileVars) ([]byte, error) {
+func marathonPrepare(f flags, conf config, vars fileVars) (marathonGroup, []byte, error) {
 
 	// Build file path
 	filePath := f.configDir + "/" + conf.Environments[f.env].Marathon.File
 
 	// Read file into a template and parse
-	fileData, err := fileLoad(filePath, vars)
+	fileData, err := fileLoad(filePath, f.configDir, conf.Partials, vars)
 	if err != nil {
-		return nil, fmt.Errorf(
+		return marathonGroup{}, nil, fmt.Errorf(
 			"Unable to load '%s' Marathon file:\n%s",
 			conf.Environments[f.env].Marathon.File,
 			err,
@@ -120,33 +119,59 @@ func marathonPrepare(f flags, conf config, vars fileVars) ([]byte, error) {
 	}
 
 	// Unmarshal YAML and validate
-	group, err := marathonParseYAML(fileData)
+	group, err := marathonParseYAML(conf.Environments[f.env].Marathon.File, fileData)
 	if err != nil {
-		return nil, err
+		return marathonGroup{}, nil, err
+	}
+	if conf.Metadata.Labels {
+		err = marathonAddMetadataLabels(&group, vars, conf.Git.RequireClean, f.imageTag == "")
+		if err != nil {
+			return marathonGroup{}, nil, err
+		}
 	}
 	err = marathonValidate(group)
 	if err != nil {
-		return nil, err
+		return marathonGroup{}, nil, err
 	}
 
 	// Marshal JSON
 	marathonJSON, err := json.MarshalIndent(group, "", "    ")
 	if err != nil {
-		return nil, fmt.Errorf(
+		return marathonGroup{}, nil, fmt.Errorf(
 			"Error marshaling JSON: %s",
 			err,
 		)
 	}
 
-	return marathonJSON, nil
+	return group, marathonJSON, nil
 
 }
 
-func marathonParseYAML(fileData []byte) (marathonGroup, error) {
+// marathonFormat converts the JSON returned by marathonPrepare to the given
+// output format (json or yaml)
+func marathonFormat(jsonConfig []byte, format string) ([]byte, error) {
+	switch format {
+	case "", "json":
+		return append(jsonConfig, '\n'), nil
+	case "yaml":
+		// JSON is valid YAML, so decode it preserving the key order
+		var group yaml.MapSlice
+		err := yaml.Unmarshal(jsonConfig, &group)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JSON: %s", err)
+		}
+		return yaml.Marshal(group)
+	}
+	return nil, fmt.Errorf("Unknown output format '%s'", format)
+}
+
+// marathonParseYAML parses a rendered Marathon file. Unknown fields are
+// errors, which give the file name & position.
+func marathonParseYAML(fileName string, fileData []byte) (marathonGroup, error) {
 
 	// Parse file YAML
 	var group marathonGroup
-	err := yaml.Unmarshal(fileData, &group)
+	err := yamlUnmarshalStrict(fileName, fileData, &group)
 	if err != nil {
 		return marathonGroup{}, err
 	}
@@ -156,6 +181,57 @@ func marathonParseYAML(fileData []byte) (marathonGroup, error) {
 
 }
 
+// marathonAddMetadataLabels labels every app with the deployment metadata.
+// Labels set in the Marathon file aren't replaced. Changing a label restarts
+// the app, so the time isn't added (or every deploy would restart every app),
+// but apps are restarted when someone else deploys the same commit.
+//
+// The git-sha label is only added if useGit is set (i.e. -tag isn't given),
+// and is skipped with a warning if git can't be run. If requireClean is set
+// it can't be added to uncommitted code, or skipped.
+func marathonAddMetadataLabels(group *marathonGroup, vars fileVars, requireClean, useGit bool) error {
+	labels := map[string]string{
+		"cfdeploy.environment": vars.Environment,
+		"cfdeploy.deployed-by": vars.User,
+	}
+	if useGit {
+		if requireClean {
+			err := gitCheckClean("the cfdeploy.git-sha label")
+			if err != nil {
+				return fmt.Errorf("Error adding metadata labels: %s", err)
+			}
+		}
+		rev, err := vars.GitRevFull()
+		if err != nil && requireClean {
+			return fmt.Errorf("Error adding metadata labels: %s", err)
+		} else if err != nil {
+			log.Printf("Warning: not adding the cfdeploy.git-sha label: %s\n", err)
+		}
+		labels["cfdeploy.git-sha"] = rev
+	}
+	marathonAddLabels(group, labels)
+	return nil
+}
+
+// marathonAddLabels adds labels to every app in a group, unless the app
+// already has a label with the same name
+func marathonAddLabels(group *marathonGroup, labels map[string]string) {
+	for i := range group.Apps {
+		app := &group.Apps[i]
+		if app.Labels == nil {
+			app.Labels = map[string]string{}
+		}
+		for key, value := range labels {
+			if _, ok := app.Labels[key]; !ok && value != "" {
+				app.Labels[key] = value
+			}
+		}
+	}
+	for i := range group.Groups {
+		marathonAddLabels(&group.Groups[i], labels)
+	}
+}
+
 func marathonValidate(group marathonGroup) error {
 	if group.ID == "" {
 		return fmt.Errorf("App id '%s' invalid", group.ID)
@@ -192,8 +268,16 @@ func marathonValidate(group marathonGroup) error {
 	return nil
 }
 
+func marathonBaseURL(conf config) string {
+	scheme := conf.Marathon.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, conf.Marathon.Host)
+}
+
 func marathonURL(conf config, force bool) string {
-	url := fmt.Sprintf("https://%s/v2/groups", conf.Marathon.Host)
+	url := marathonBaseURL(conf) + "/v2/groups"
 	if force {
 		url = url + "?force=true"
 	}
@@ -211,25 +295,18 @@ func marathonPush(conf config, jsonConfig []byte, force bool) (marathonResult, e
 			err,
 		)
 	}
-	req, err := http.NewRequest("PUT", u, bytes.NewBuffer(jsonConfig))
-	if err != nil {
-		return marathonResult{}, fmt.Errorf(
-			"Error building HTTP request: %s",
-			err,
-		)
-	}
-	if len(conf.Marathon.Headers) > 0 {
-		req.Header = conf.Marathon.Headers
+	header := http.Header{}
+	for key, values := range conf.Marathon.Headers {
+		header[key] = values
 	}
-	req.Header.Set("Content-Type", "application/json")
+	header.Set("Content-Type", "application/json")
 
 	// Send request
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	client, err := marathonClient(conf)
+	if err != nil {
+		return marathonResult{}, err
 	}
-	resp, err := client.Do(req)
+	resp, respBody, err := httpDo(client, "PUT", u, header, jsonConfig)
 	if err != nil {
 		return marathonResult{}, fmt.Errorf(
 			"Error with PUT %s: %s",
@@ -237,15 +314,6 @@ func marathonPush(conf config, jsonConfig []byte, force bool) (marathonResult, e
 			err,
 		)
 	}
-	// Get response
-	respBody, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close() // #nosec G104
-	if err != nil {
-		return marathonResult{}, fmt.Errorf(
-			"Error reading response: %s",
-			err,
-		)
-	}
 	// Parse response
 	var result marathonResult
 	if len(respBody) > 0 {
@@ -267,11 +335,15 @@ func marathonPush(conf config, jsonConfig []byte, force bool) (marathonResult, e
 			result,
 		)
 	} else if resp.StatusCode == 422 {
+		printConfig, err := redactGroupJSON(jsonConfig)
+		if err != nil {
+			printConfig = []byte(redactHidden)
+		}
 		return marathonResult{}, fmt.Errorf(
 			"%s\nResult: %+v\n\nConfig: %s",
 			resp.Status,
 			result,
-			jsonConfig,
+			printConfig,
 		)
 	} else if resp.StatusCode != 200 {
 		return marathonResult{}, fmt.Errorf(
@@ -289,3 +361,83 @@ func marathonPush(conf config, jsonConfig []byte, force bool) (marathonResult, e
 	}
 	return result, nil
 }
+
+// marathonError is returned by marathonRequest for non-2xx responses
+type marathonError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+	Body       []byte
+}
+
+func (e marathonError) Error() string {
+	return fmt.Sprintf("%s %s\n%s\nResponse: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// marathonClient returns the HTTP client used for all Marathon requests.
+// Redirects are not followed as they usually point to a login page.
+func marathonClient(conf config) (*http.Client, error) {
+	client, err := httpClient(conf.Marathon.TLS)
+	if err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client, nil
+}
+
+// marathonRequest sends a request to the Marathon API path (e.g. /v2/info)
+// and decodes a JSON response into v (if v is not nil)
+func marathonRequest(conf config, method, path string, body []byte, v interface{}) error {
+	// Prepare request
+	u := marathonBaseURL(conf) + path
+	header := http.Header{}
+	for key, values := range conf.Marathon.Headers {
+		header[key] = values
+	}
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+
+	// Send request
+	client, err := marathonClient(conf)
+	if err != nil {
+		return err
+	}
+	resp, respBody, err := httpDo(client, method, u, header, body)
+	if err != nil {
+		return fmt.Errorf(
+			"Error with %s %s: %s",
+			method,
+			u,
+			err,
+		)
+	}
+
+	// Check response status
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return marathonError{
+			Method:     method,
+			URL:        u,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       respBody,
+		}
+	}
+
+	// Parse response
+	if v != nil && len(respBody) > 0 {
+		err = json.Unmarshal(respBody, v)
+		if err != nil {
+			return fmt.Errorf(
+				"%s %s\nError parsing response json: %s",
+				method,
+				u,
+				err,
+			)
+		}
+	}
+	return nil
+}
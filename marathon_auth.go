@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// marathonDCOSLoginPath is the DC/OS IAM login endpoint
+const marathonDCOSLoginPath = "/acs/api/v1/auth/login"
+
+// marathonAuthenticate adds the headers configured by marathon.auth to the
+// Marathon headers, logging in to DC/OS if required
+func marathonAuthenticate(conf *config) error {
+	auth := conf.Marathon.Auth
+	headers := http.Header{}
+	for key, values := range conf.Marathon.Headers {
+		headers[key] = values
+	}
+
+	// Extra headers
+	if auth.Headers != nil {
+		text, err := auth.Headers.Get()
+		if err != nil {
+			return fmt.Errorf("Error reading marathon.auth.headers: %s", err)
+		}
+		extra, err := marathonParseHeaders(text)
+		if err != nil {
+			return fmt.Errorf("Error reading marathon.auth.headers: %s", err)
+		}
+		for key, values := range extra {
+			headers[key] = values
+		}
+	}
+
+	// Authorization header
+	switch {
+	case auth.Basic != nil:
+		password, err := auth.Basic.Password.Get()
+		if err != nil {
+			return fmt.Errorf("Error reading marathon.auth.basic.password: %s", err)
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(auth.Basic.Username + ":" + password))
+		headers.Set("Authorization", "Basic "+credentials)
+	case auth.Token != nil:
+		token, err := auth.Token.Get()
+		if err != nil {
+			return fmt.Errorf("Error reading marathon.auth.token: %s", err)
+		}
+		headers.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	case auth.DCOS != nil:
+		token, err := marathonDCOSLogin(*conf)
+		if err != nil {
+			return err
+		}
+		redactAddValue(token)
+		headers.Set("Authorization", "token="+token)
+	}
+
+	redactHeaders(headers)
+	conf.Marathon.Headers = headers
+	return nil
+}
+
+// marathonAuthMethod describes the configured auth method e.g. "basic
+// (deploy)", or returns "" if there is none
+func marathonAuthMethod(auth configMarathonAuth) string {
+	switch {
+	case auth.Basic != nil:
+		return "basic (" + auth.Basic.Username + ")"
+	case auth.Token != nil:
+		return "token"
+	case auth.DCOS != nil:
+		return "DC/OS service account (" + auth.DCOS.UID + ")"
+	}
+	return ""
+}
+
+// marathonParseHeaders parses "Name: value" lines. Blank lines and lines
+// starting with # are ignored.
+func marathonParseHeaders(text string) (http.Header, error) {
+	headers := http.Header{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, err := configParseHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		headers.Add(key, value)
+	}
+	return headers, nil
+}
+
+// marathonDCOSLogin logs in to DC/OS as a service account, returning an
+// auth token. The login request contains a JWT signed by the account's
+// private key.
+func marathonDCOSLogin(conf config) (string, error) {
+	dcos := conf.Marathon.Auth.DCOS
+	pemKey, err := dcos.PrivateKey.Get()
+	if err != nil {
+		return "", fmt.Errorf("Error reading marathon.auth.dcos.privateKey: %s", err)
+	}
+	key, err := marathonParsePrivateKey([]byte(pemKey))
+	if err != nil {
+		return "", fmt.Errorf("Error reading marathon.auth.dcos.privateKey: %s", err)
+	}
+	jwt, err := marathonJWT(key, map[string]interface{}{
+		"uid": dcos.UID,
+		"exp": time.Now().Add(5 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"uid": dcos.UID, "token": jwt})
+	if err != nil {
+		return "", err
+	}
+
+	// Send login request
+	loginURL := dcos.LoginURL
+	if loginURL == "" {
+		loginURL = marathonBaseURL(conf) + marathonDCOSLoginPath
+	}
+	client, err := marathonClient(conf)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	resp, respBody, err := httpDo(client, "POST", loginURL, header, body)
+	if err != nil {
+		return "", fmt.Errorf("Error with POST %s: %s", loginURL, err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf(
+			"DC/OS login as '%s' failed\nPOST %s\n%s\nResponse: %s",
+			dcos.UID,
+			loginURL,
+			resp.Status,
+			respBody,
+		)
+	}
+	var result struct {
+		Token string `json:"token"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return "", fmt.Errorf("POST %s\nError parsing response json: %s", loginURL, err)
+	}
+	if result.Token == "" {
+		return "", fmt.Errorf("POST %s\nDC/OS login response has no token", loginURL)
+	}
+	return result.Token, nil
+}
+
+// marathonParsePrivateKey parses a PEM encoded PKCS #1 or PKCS #8 RSA key
+func marathonParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM private key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// marathonJWT builds a JWT signed with RS256
+func marathonJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("Error signing JWT: %s", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
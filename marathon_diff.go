@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// marathonGroupGet returns the group currently deployed in Marathon. exists
+// is false if the group has not been deployed yet.
+func marathonGroupGet(conf config, groupID string) (group marathonGroup, exists bool, err error) {
+	err = marathonRequest(conf, "GET", marathonGroupPath(groupID)+"?embed=group.apps", nil, &group)
+	if e, ok := err.(marathonError); ok && e.StatusCode == 404 {
+		return marathonGroup{}, false, nil
+	}
+	if err != nil {
+		return marathonGroup{}, false, err
+	}
+	return group, true, nil
+}
+
+// marathonFieldChange is a single changed field of an app
+type marathonFieldChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+// marathonAppDiff lists the changes to a single app
+type marathonAppDiff struct {
+	ID      string
+	Added   bool
+	Removed bool
+	Changes []marathonFieldChange
+}
+
+// marathonAbsoluteID resolves an app/group id relative to its parent group
+func marathonAbsoluteID(parentID, id string) string {
+	if strings.HasPrefix(id, "/") {
+		return path.Clean(id)
+	}
+	return path.Join("/", parentID, id)
+}
+
+// marathonGroupApps returns all apps in a group (and sub-groups) keyed by
+// absolute app id
+func marathonGroupApps(group marathonGroup, parentID string) map[string]marathonApp {
+	apps := map[string]marathonApp{}
+	groupID := marathonAbsoluteID(parentID, group.ID)
+	for _, app := range group.Apps {
+		app.ID = marathonAbsoluteID(groupID, app.ID)
+		apps[app.ID] = app
+	}
+	for _, subGroup := range group.Groups {
+		for id, app := range marathonGroupApps(subGroup, groupID) {
+			apps[id] = app
+		}
+	}
+	return apps
+}
+
+// marathonFlattenApp converts an app into a map of field path => JSON value
+// e.g. "container.docker.image" => "\"index.docker.io/library/hello-world:1\""
+func marathonFlattenApp(app marathonApp) (map[string]string, error) {
+	data, err := json.Marshal(app)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&tree)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	marathonFlatten("", tree, fields)
+	delete(fields, "id")
+	return fields, nil
+}
+
+func marathonFlatten(prefix string, value interface{}, fields map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			marathonFlatten(key, child, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			marathonFlatten(fmt.Sprintf("%s[%d]", prefix, i), child, fields)
+		}
+	case nil:
+	default:
+		data, _ := json.Marshal(v) // #nosec G104
+		fields[prefix] = string(data)
+	}
+}
+
+// marathonMapPath returns the map containing a field if it is an entry of a
+// map whose keys are chosen by the user (e.g. "env" for env.DB_HOST), rather
+// than a field of an object
+func marathonMapPath(field string) string {
+	for _, path := range []string{"env", "labels", "ipAddress.labels"} {
+		if strings.HasPrefix(field, path+".") {
+			return path
+		}
+	}
+	return ""
+}
+
+// marathonFieldPrefixes returns every field path and every object or array
+// element containing one e.g. "healthChecks[0].path" gives "healthChecks",
+// "healthChecks[0]" and "healthChecks[0].path"
+func marathonFieldPrefixes(fields map[string]string) map[string]bool {
+	prefixes := map[string]bool{}
+	for field := range fields {
+		prefixes[field] = true
+		for i, c := range field {
+			if c == '.' || c == '[' {
+				prefixes[field[:i]] = true
+			}
+		}
+	}
+	return prefixes
+}
+
+// marathonRemovedField returns true if a field only set in Marathon has been
+// removed locally: an entry of a map (e.g. env) which is set locally, or a
+// field of an array element which the local array doesn't have. Other
+// fields (at any depth) are usually Marathon defaults, so are ignored.
+func marathonRemovedField(field string, desiredPrefixes map[string]bool) bool {
+	if path := marathonMapPath(field); path != "" {
+		return desiredPrefixes[path]
+	}
+	for i, c := range field {
+		if c != '[' {
+			continue
+		}
+		end := strings.Index(field[i:], "]")
+		if end < 0 {
+			break
+		}
+		array, element := field[:i], field[:i+end+1]
+		if desiredPrefixes[array] && !desiredPrefixes[element] {
+			return true
+		}
+	}
+	return false
+}
+
+// marathonPortField returns true if the field is a port number. A port of 0
+// is assigned by Marathon, so will always differ from the deployed app.
+func marathonPortField(field string) bool {
+	return strings.HasPrefix(field, "ports[") ||
+		(strings.HasPrefix(field, "portDefinitions[") && strings.HasSuffix(field, "].port"))
+}
+
+// marathonDiffApp compares the fields of two apps. Fields which are only set
+// in Marathon are ignored unless they have been removed locally (see
+// marathonRemovedField), as they are usually Marathon defaults.
+func marathonDiffApp(current, desired marathonApp) ([]marathonFieldChange, error) {
+	currentFields, err := marathonFlattenApp(current)
+	if err != nil {
+		return nil, err
+	}
+	desiredFields, err := marathonFlattenApp(desired)
+	if err != nil {
+		return nil, err
+	}
+	desiredPrefixes := marathonFieldPrefixes(desiredFields)
+	var changes []marathonFieldChange
+	for field, to := range desiredFields {
+		if to == "0" && marathonPortField(field) {
+			continue
+		}
+		if from, ok := currentFields[field]; !ok || from != to {
+			changes = append(changes, marathonFieldChange{Field: field, From: from, To: to})
+		}
+	}
+	for field, from := range currentFields {
+		if _, ok := desiredFields[field]; !ok && marathonRemovedField(field, desiredPrefixes) {
+			changes = append(changes, marathonFieldChange{Field: field, From: from})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+// marathonDiff compares the group currently in Marathon with the desired
+// group and returns the changed, added and removed apps
+func marathonDiff(current, desired marathonGroup) ([]marathonAppDiff, error) {
+	currentApps := marathonGroupApps(current, "/")
+	desiredApps := marathonGroupApps(desired, "/")
+	var diffs []marathonAppDiff
+	for id, desiredApp := range desiredApps {
+		currentApp, ok := currentApps[id]
+		if !ok {
+			diffs = append(diffs, marathonAppDiff{ID: id, Added: true})
+			continue
+		}
+		changes, err := marathonDiffApp(currentApp, desiredApp)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) > 0 {
+			diffs = append(diffs, marathonAppDiff{ID: id, Changes: changes})
+		}
+	}
+	for id := range currentApps {
+		if _, ok := desiredApps[id]; !ok {
+			diffs = append(diffs, marathonAppDiff{ID: id, Removed: true})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].ID < diffs[j].ID
+	})
+	return diffs, nil
+}
+
+// marathonDiffString formats a diff for printing
+func marathonDiffString(diffs []marathonAppDiff) string {
+	if len(diffs) == 0 {
+		return "No changes\n"
+	}
+	var buf bytes.Buffer
+	for _, diff := range diffs {
+		switch {
+		case diff.Added:
+			fmt.Fprintf(&buf, "+ %s (new app)\n", diff.ID)
+		case diff.Removed:
+			fmt.Fprintf(&buf, "- %s (removed)\n", diff.ID)
+		default:
+			fmt.Fprintf(&buf, "~ %s\n", diff.ID)
+			for _, change := range diff.Changes {
+				from, to := change.From, change.To
+				if marathonSecretField(change.Field) {
+					from, to = marathonHideValue(from), marathonHideValue(to)
+				}
+				if from == "" {
+					from = "(unset)"
+				}
+				if to == "" {
+					to = "(unset)"
+				}
+				fmt.Fprintf(&buf, "    %s: %s => %s\n", change.Field, from, to)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// marathonSecretField returns true if the field is a secret env var or
+// label (e.g. env.DB_PASSWORD), whose values shouldn't be shown even though
+// they have changed
+func marathonSecretField(field string) bool {
+	if !strings.HasPrefix(field, "env.") && !strings.HasPrefix(field, "labels.") {
+		return false
+	}
+	return redactKey(field[strings.Index(field, ".")+1:])
+}
+
+// marathonHideValue hides a (non-empty) value
+func marathonHideValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactHidden
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMarathonDiff(t *testing.T) {
+	desired, err := marathonParseYAML("marathon.yaml", []byte(marathonExampleYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing YAML: %s", err)
+	}
+	desired.Apps[0].Container.Docker.Image = "index.docker.io/library/hello-world:2"
+
+	tests := []struct {
+		current string
+		expect  string
+	}{
+		// Group as returned by Marathon (absolute ids, defaults, assigned
+		// ports, changed image/env). Secret values are hidden.
+		{
+			current: `{
+				"id": "/path/to/apps",
+				"version": "2017-08-01T12:00:00.000Z",
+				"apps": [{
+					"id": "/path/to/apps/svc",
+					"cpus": 0.2,
+					"mem": 512,
+					"instances": 1,
+					"ports": [10001],
+					"backoffSeconds": 1,
+					"container": {
+						"type": "DOCKER",
+						"docker": {
+							"image": "index.docker.io/library/hello-world:1",
+							"network": "HOST",
+							"parameters": [{"key": "log-driver", "value": "journald"}]
+						},
+						"volumes": [{"containerPath": "/run/pald", "hostPath": "/run/pald", "mode": "RO"}]
+					},
+					"env": {"SOME_ENV_VAR": "some-env-var-value", "OLD_VAR": "x", "DB_PASSWORD": "hunter22"},
+					"labels": {"some_label": "some_label_value"},
+					"healthChecks": [{
+						"protocol": "HTTP",
+						"path": "/_healthcheck",
+						"command": {"value": "foo"},
+						"gracePeriodSeconds": 3,
+						"intervalSeconds": 10,
+						"timeoutSeconds": 10,
+						"maxConsecutiveFailures": 3
+					}]
+				}, {
+					"id": "/path/to/apps/old",
+					"instances": 1
+				}]
+			}`,
+			expect: "- /path/to/apps/old (removed)\n" +
+				"~ /path/to/apps/svc\n" +
+				"    container.docker.image: \"index.docker.io/library/hello-world:1\" => \"index.docker.io/library/hello-world:2\"\n" +
+				"    env.DB_PASSWORD: [hidden] => (unset)\n" +
+				"    env.OLD_VAR: \"x\" => (unset)\n",
+		},
+		// Empty group
+		{
+			current: `{"id": "/path/to/apps"}`,
+			expect:  "+ /path/to/apps/svc (new app)\n",
+		},
+	}
+	for i, test := range tests {
+		var current marathonGroup
+		if err := json.Unmarshal([]byte(test.current), &current); err != nil {
+			t.Fatalf("(%d) Unexpected error parsing JSON: %s", i, err)
+		}
+		diffs, err := marathonDiff(current, desired)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error: %s", i, err)
+		}
+		if got := marathonDiffString(diffs); got != test.expect {
+			t.Errorf("(%d) Diff mismatch.\nExpected:\n%s\nGot:\n%s", i, test.expect, got)
+		}
+	}
+}
+
+func TestMarathonDiffDefaults(t *testing.T) {
+	desired, err := marathonParseYAML("marathon.yaml", []byte(`
+id: /web
+apps:
+  - id: web
+    instances: 2
+    cpus: 0.5
+    mem: 256
+    args: [serve, -v]
+    container:
+      type: DOCKER
+      docker: {image: "registry.example.com/web:1", network: BRIDGE}
+    env: {LOG_LEVEL: info}
+    healthChecks:
+      - {protocol: HTTP, path: /h}
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing YAML: %s", err)
+	}
+
+	// The app as returned by Marathon, with its defaults filled in
+	app := `{
+		"id": "/web/web",
+		"args": %s,
+		"instances": 2,
+		"cpus": 0.5,
+		"mem": 256,
+		"disk": 0,
+		"constraints": [],
+		"portDefinitions": [{"port": 10000, "protocol": "tcp", "name": "default"}],
+		"requirePorts": false,
+		"backoffSeconds": 1,
+		"backoffFactor": 1.15,
+		"maxLaunchDelaySeconds": 3600,
+		"taskKillGracePeriodSeconds": 0,
+		"container": {
+			"type": "DOCKER",
+			"volumes": [],
+			"docker": {
+				"image": "registry.example.com/web:1",
+				"network": "BRIDGE",
+				"parameters": [],
+				"privileged": false,
+				"forcePullImage": false
+			}
+		},
+		"env": %s,
+		"labels": {},
+		"healthChecks": %s,
+		"upgradeStrategy": {"minimumHealthCapacity": 1, "maximumOverCapacity": 1},
+		"version": "2017-08-01T12:00:00.000Z"
+	}`
+	healthCheck := `{"protocol": "HTTP", "path": "/h", "portIndex": 0, "gracePeriodSeconds": 300, "intervalSeconds": 60, "timeoutSeconds": 20, "maxConsecutiveFailures": 3, "ignoreHttp1xx": false}`
+	tests := []struct {
+		args         string
+		env          string
+		healthChecks string
+		expect       string
+	}{
+		// Marathon's defaults aren't changes, at any depth
+		{
+			args:         `["serve", "-v"]`,
+			env:          `{"LOG_LEVEL": "info"}`,
+			healthChecks: "[" + healthCheck + "]",
+			expect:       "No changes\n",
+		},
+		// Removed env vars, array elements & health checks are
+		{
+			args:         `["serve", "-v", "-debug"]`,
+			env:          `{"LOG_LEVEL": "info", "DEBUG": "1"}`,
+			healthChecks: "[" + healthCheck + ", {\"protocol\": \"TCP\", \"gracePeriodSeconds\": 300}]",
+			expect: "~ /web/web\n" +
+				"    args[2]: \"-debug\" => (unset)\n" +
+				"    env.DEBUG: \"1\" => (unset)\n" +
+				"    healthChecks[1].gracePeriodSeconds: 300 => (unset)\n" +
+				"    healthChecks[1].protocol: \"TCP\" => (unset)\n",
+		},
+	}
+	for i, test := range tests {
+		var current marathonGroup
+		data := fmt.Sprintf(`{"id": "/web", "apps": [`+app+`]}`, test.args, test.env, test.healthChecks)
+		if err := json.Unmarshal([]byte(data), &current); err != nil {
+			t.Fatalf("(%d) Unexpected error parsing JSON: %s", i, err)
+		}
+		diffs, err := marathonDiff(current, desired)
+		if err != nil {
+			t.Fatalf("(%d) Unexpected error: %s", i, err)
+		}
+		if got := marathonDiffString(diffs); got != test.expect {
+			t.Errorf("(%d) Diff mismatch.\nExpected:\n%s\nGot:\n%s", i, test.expect, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// marathonGroupVersion returns the current version of a group, or an empty
+// string if the group does not exist (yet)
+func marathonGroupVersion(conf config, groupID string) (string, error) {
+	var group struct {
+		Version string `json:"version"`
+	}
+	err := marathonRequest(conf, "GET", marathonGroupPath(groupID), nil, &group)
+	if e, ok := err.(marathonError); ok && e.StatusCode == 404 {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return group.Version, nil
+}
+
+// marathonCancelDeployment stops a running deployment. force=true is used so
+// that Marathon does not start its own rollback deployment.
+func marathonCancelDeployment(conf config, deploymentID string) error {
+	err := marathonRequest(
+		conf,
+		"DELETE",
+		"/v2/deployments/"+deploymentID+"?force=true",
+		nil,
+		nil,
+	)
+	// Deployment already finished
+	if e, ok := err.(marathonError); ok && e.StatusCode == 404 {
+		return nil
+	}
+	return err
+}
+
+// marathonRollback cancels a deployment (if still running) and deploys a
+// previous version of the group
+func marathonRollback(conf config, groupID, deploymentID, version string) (marathonResult, error) {
+	// Cancel failed deployment
+	if deploymentID != "" {
+		err := marathonCancelDeployment(conf, deploymentID)
+		if err != nil {
+			return marathonResult{}, fmt.Errorf(
+				"Error cancelling deployment %s: %s",
+				deploymentID,
+				err,
+			)
+		}
+	}
+
+	// Re-deploy previous group version
+	body, err := json.Marshal(struct {
+		Version string `json:"version"`
+	}{version})
+	if err != nil {
+		return marathonResult{}, err
+	}
+	var result marathonResult
+	err = marathonRequest(
+		conf,
+		"PUT",
+		marathonGroupPath(groupID)+"?force=true",
+		body,
+		&result,
+	)
+	if err != nil {
+		return marathonResult{}, fmt.Errorf(
+			"Error rolling back group %s to version %s: %s",
+			groupID,
+			version,
+			err,
+		)
+	}
+	if result.DeploymentID == "" {
+		return marathonResult{}, fmt.Errorf(
+			"Deployment ID empty. Result: %+v",
+			result,
+		)
+	}
+	return result, nil
+}
+
+// marathonGroupVersions returns all versions of a group, newest first
+func marathonGroupVersions(conf config, groupID string) ([]string, error) {
+	var versions []string
+	err := marathonRequest(conf, "GET", marathonGroupPath(groupID)+"/versions", nil, &versions)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+	return versions, nil
+}
+
+// marathonPreviousVersion returns the newest version older than current
+func marathonPreviousVersion(versions []string, current string) string {
+	for _, version := range versions {
+		if version < current {
+			return version
+		}
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMarathonPreviousVersion(t *testing.T) {
+	versions := []string{
+		"2017-08-03T10:00:00.000Z",
+		"2017-08-02T10:00:00.000Z",
+		"2017-08-01T10:00:00.000Z",
+	}
+	tests := []struct {
+		current string
+		expect  string
+	}{
+		{current: "2017-08-03T10:00:00.000Z", expect: "2017-08-02T10:00:00.000Z"},
+		{current: "2017-08-02T10:00:00.000Z", expect: "2017-08-01T10:00:00.000Z"},
+		{current: "2017-08-01T10:00:00.000Z", expect: ""},
+	}
+	for i, test := range tests {
+		got := marathonPreviousVersion(versions, test.current)
+		if got != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+// marathonTestServer starts a fake Marathon which handles requests with the
+// given handlers (keyed by method & path e.g. "GET /v2/groups/g"), and
+// returns a config using it
+func marathonTestServer(t *testing.T, handlers map[string]http.HandlerFunc) (config, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method+" "+r.URL.Path]
+		if !ok {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(500)
+			return
+		}
+		handler(w, r)
+	}))
+	var c config
+	c.Marathon.Host = strings.TrimPrefix(server.URL, "http://")
+	c.Marathon.Scheme = "http"
+	return c, server.Close
+}
+
+func marathonTestRespond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body)) // #nosec G104
+	}
+}
+
+func TestMarathonGroupVersion(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		expect string
+		err    bool
+	}{
+		{status: 200, body: `{"id":"/g","version":"2017-08-02T10:00:00.000Z"}`, expect: "2017-08-02T10:00:00.000Z"},
+		// Group not deployed yet
+		{status: 404, body: `{"message":"Group '/g' does not exist"}`, expect: ""},
+		{status: 403, body: `{"message":"Not authorized"}`, err: true},
+	}
+	for i, test := range tests {
+		c, done := marathonTestServer(t, map[string]http.HandlerFunc{
+			"GET /v2/groups/g": marathonTestRespond(test.status, test.body),
+		})
+		got, err := marathonGroupVersion(c, "/g")
+		done()
+		if test.err {
+			if err == nil {
+				t.Errorf("(%d) Expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if got != test.expect {
+			t.Errorf("(%d) Expected '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
+
+func TestMarathonCancelDeployment(t *testing.T) {
+	tests := []struct {
+		status int
+		err    bool
+	}{
+		{status: 200},
+		// Deployment already finished
+		{status: 404},
+		{status: 403, err: true},
+	}
+	for i, test := range tests {
+		var force string
+		c, done := marathonTestServer(t, map[string]http.HandlerFunc{
+			"DELETE /v2/deployments/d1": func(w http.ResponseWriter, r *http.Request) {
+				force = r.URL.Query().Get("force")
+				marathonTestRespond(test.status, `{}`)(w, r)
+			},
+		})
+		err := marathonCancelDeployment(c, "d1")
+		done()
+		if test.err != (err != nil) {
+			t.Errorf("(%d) Expected error %t, got: %v", i, test.err, err)
+		}
+		if force != "true" {
+			t.Errorf("(%d) Expected force=true, got '%s'", i, force)
+		}
+	}
+}
+
+func TestMarathonRollback(t *testing.T) {
+	var cancelled bool
+	var put struct {
+		Version string `json:"version"`
+	}
+	c, done := marathonTestServer(t, map[string]http.HandlerFunc{
+		"DELETE /v2/deployments/d1": func(w http.ResponseWriter, r *http.Request) {
+			cancelled = true
+			w.WriteHeader(404)
+		},
+		"PUT /v2/groups/g": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("force") != "true" || json.NewDecoder(r.Body).Decode(&put) != nil {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte(`{"deploymentId":"d2","version":"2017-08-04T10:00:00.000Z"}`)) // #nosec G104
+		},
+	})
+	defer done()
+
+	result, err := marathonRollback(c, "/g", "d1", "2017-08-02T10:00:00.000Z")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !cancelled {
+		t.Errorf("Expected deployment d1 to be cancelled")
+	}
+	if put.Version != "2017-08-02T10:00:00.000Z" {
+		t.Errorf("Expected PUT of version 2017-08-02T10:00:00.000Z, got '%s'", put.Version)
+	}
+	if result.DeploymentID != "d2" {
+		t.Errorf("Expected deployment ID 'd2', got '%s'", result.DeploymentID)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"reflect"
 	"testing"
 )
 
@@ -44,7 +45,7 @@ apps:
 `
 
 func TestMarathonParseYAML(t *testing.T) {
-	app, err := marathonParseYAML([]byte(marathonExampleYAML))
+	app, err := marathonParseYAML("marathon.yaml", []byte(marathonExampleYAML))
 	if err != nil {
 		t.Errorf("Error parsing Marathon YAML: %s", err)
 	}
@@ -59,8 +60,8 @@ func TestMarathonParseYAML(t *testing.T) {
 }
 
 func TestMarathonValidate(t *testing.T) {
-	exampleAppInvalid, _ := marathonParseYAML([]byte(marathonExampleYAML))
-	exampleAppValid, _ := marathonParseYAML([]byte(marathonExampleYAML))
+	exampleAppInvalid, _ := marathonParseYAML("marathon.yaml", []byte(marathonExampleYAML))
+	exampleAppValid, _ := marathonParseYAML("marathon.yaml", []byte(marathonExampleYAML))
 	exampleAppValid.Apps[0].Container.Docker.Image = "index.docker.io/library/hello-world:latest"
 	tests := []struct {
 		app marathonGroup
@@ -116,9 +117,15 @@ func TestMarathonParseYAMLPorts(t *testing.T) {
 			expectError:  true,
 			validateFunc: nil,
 		},
+		// Unknown fields are errors
+		{
+			yaml:         "apps: [{id: svc, instance: 2}]",
+			expectError:  true,
+			validateFunc: nil,
+		},
 	}
 	for i, test := range tests {
-		config, err := marathonParseYAML([]byte(test.yaml))
+		config, err := marathonParseYAML("marathon.yaml", []byte(test.yaml))
 		switch {
 		case err != nil && test.expectError:
 		case err == nil && test.expectError:
@@ -163,7 +170,7 @@ func TestMarathonYAMLtoJSON(t *testing.T) {
 		},
 	}
 	for i, test := range tests {
-		config, err := marathonParseYAML(test.yaml)
+		config, err := marathonParseYAML("marathon.yaml", test.yaml)
 		if err != nil {
 			t.Fatalf("(%d) Unexpected error parsing YAML: %s", i, err)
 		}
@@ -180,3 +187,127 @@ func TestMarathonYAMLtoJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestMarathonFormat(t *testing.T) {
+	jsonConfig := []byte(`{"id":"/path/to/apps","apps":[{"id":"svc","instances":2,"env":{"B":"1","A":"2"}}]}`)
+	tests := []struct {
+		format string
+		expect string
+		err    string
+	}{
+		{
+			format: "json",
+			expect: string(jsonConfig) + "\n",
+		},
+		// Key order is kept
+		{
+			format: "yaml",
+			expect: "id: /path/to/apps\napps:\n- id: svc\n  instances: 2\n  env:\n    B: \"1\"\n    A: \"2\"\n",
+		},
+		{
+			format: "toml",
+			err:    "Unknown output format 'toml'",
+		},
+	}
+	for i, test := range tests {
+		output, err := marathonFormat(jsonConfig, test.format)
+		if err != nil && test.err == "" {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if err == nil && test.err != "" {
+			t.Errorf("(%d) Expected error '%s' but no error occurred", i, test.err)
+		} else if err != nil && err.Error() != test.err {
+			t.Errorf("(%d) Expected error '%s' but got '%s'", i, test.err, err)
+		} else if string(output) != test.expect {
+			t.Errorf("(%d) Expected:\n%s\nGot:\n%s", i, test.expect, output)
+		}
+	}
+}
+
+func TestMarathonAddMetadataLabels(t *testing.T) {
+	git := map[string]string{
+		"rev-parse HEAD":     "5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20",
+		"status --porcelain": "",
+	}
+	defer gitStub(git)()
+
+	group, err := marathonParseYAML("marathon.yaml", []byte(`
+id: /web
+apps:
+  - id: web
+    labels: {cfdeploy.environment: custom}
+groups:
+  - id: /web/workers
+    apps: [{id: worker}]
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing Marathon YAML: %s", err)
+	}
+	err = marathonAddMetadataLabels(&group, fileVars{Environment: "prod", User: "deployer"}, true, true)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	tests := []struct {
+		labels map[string]string
+		expect map[string]string
+	}{
+		// Labels set in the Marathon file aren't replaced
+		{
+			labels: group.Apps[0].Labels,
+			expect: map[string]string{
+				"cfdeploy.git-sha":     "5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20",
+				"cfdeploy.environment": "custom",
+				"cfdeploy.deployed-by": "deployer",
+			},
+		},
+		{
+			labels: group.Groups[0].Apps[0].Labels,
+			expect: map[string]string{
+				"cfdeploy.git-sha":     "5814f5e2c7d4e0ba2a2e4b0d1f8c9a6e3b7d1c20",
+				"cfdeploy.environment": "prod",
+				"cfdeploy.deployed-by": "deployer",
+			},
+		},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.labels, test.expect) {
+			t.Errorf("(%d) Expected labels %v, got %v", i, test.expect, test.labels)
+		}
+	}
+
+	// The git-sha label can't be added to uncommitted code if requireClean
+	// is set
+	git["status --porcelain"] = " M main.go"
+	defer gitStub(git)()
+	err = marathonAddMetadataLabels(&group, fileVars{}, true, true)
+	expect := "Error adding metadata labels: Refusing to use the cfdeploy.git-sha label as the git working tree has uncommitted changes (git.requireClean is set):\nM main.go"
+	if err == nil || err.Error() != expect {
+		t.Errorf("Expected error '%s', got '%v'", expect, err)
+	}
+	err = marathonAddMetadataLabels(&group, fileVars{}, false, true)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	// Outside a git repository (or with -tag) the git-sha label is skipped,
+	// unless requireClean is set
+	defer gitStub(nil)()
+	for i, useGit := range []bool{true, false} {
+		group := marathonGroup{ID: "/web", Apps: []marathonApp{{ID: "web"}}}
+		err = marathonAddMetadataLabels(&group, fileVars{Environment: "prod", User: "deployer"}, false, useGit)
+		expect := map[string]string{"cfdeploy.environment": "prod", "cfdeploy.deployed-by": "deployer"}
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if !reflect.DeepEqual(group.Apps[0].Labels, expect) {
+			t.Errorf("(%d) Expected labels %v, got %v", i, expect, group.Apps[0].Labels)
+		}
+	}
+	err = marathonAddMetadataLabels(&group, fileVars{}, true, true)
+	if err == nil {
+		t.Errorf("Expected error but no error occurred")
+	}
+	// -tag means git isn't run, even if requireClean is set
+	err = marathonAddMetadataLabels(&group, fileVars{}, true, false)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
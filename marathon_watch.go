@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// marathonWatchInterval is the delay between Marathon status polls
+var marathonWatchInterval = 2 * time.Second
+
+type marathonDeployment struct {
+	ID             string   `json:"id"`
+	Version        string   `json:"version"`
+	AffectedApps   []string `json:"affectedApps"`
+	CurrentStep    int64    `json:"currentStep"`
+	TotalSteps     int64    `json:"totalSteps"`
+	CurrentActions []struct {
+		Action string `json:"action"`
+		App    string `json:"app"`
+	} `json:"currentActions"`
+}
+
+type marathonAppStatus struct {
+	ID             string            `json:"id"`
+	Instances      int64             `json:"instances"`
+	TasksStaged    int64             `json:"tasksStaged"`
+	TasksRunning   int64             `json:"tasksRunning"`
+	TasksHealthy   int64             `json:"tasksHealthy"`
+	TasksUnhealthy int64             `json:"tasksUnhealthy"`
+	HealthChecks   []json.RawMessage `json:"healthChecks"`
+}
+
+type marathonGroupStatus struct {
+	ID      string                `json:"id"`
+	Version string                `json:"version"`
+	Apps    []marathonAppStatus   `json:"apps"`
+	Groups  []marathonGroupStatus `json:"groups"`
+}
+
+// marathonDeployments returns all deployments currently running in Marathon
+func marathonDeployments(conf config) ([]marathonDeployment, error) {
+	var deployments []marathonDeployment
+	err := marathonRequest(conf, "GET", "/v2/deployments", nil, &deployments)
+	return deployments, err
+}
+
+// marathonGroupPath returns the API path of a group (with a leading slash)
+func marathonGroupPath(groupID string) string {
+	return "/v2/groups/" + strings.TrimPrefix(groupID, "/")
+}
+
+// marathonGroupGetStatus returns a group including app task counts
+func marathonGroupGetStatus(conf config, groupID string) (marathonGroupStatus, error) {
+	var status marathonGroupStatus
+	err := marathonRequest(
+		conf,
+		"GET",
+		marathonGroupPath(groupID)+"?embed=group.apps&embed=group.apps.counts",
+		nil,
+		&status,
+	)
+	return status, err
+}
+
+// marathonUnhealthyApps returns a description of every app in the group (and
+// sub-groups) which does not yet have all of its instances running & healthy
+func marathonUnhealthyApps(status marathonGroupStatus) []string {
+	var unhealthy []string
+	for _, app := range status.Apps {
+		ready := app.TasksRunning
+		if len(app.HealthChecks) > 0 {
+			ready = app.TasksHealthy
+		}
+		if ready < app.Instances || app.TasksUnhealthy > 0 {
+			unhealthy = append(unhealthy, fmt.Sprintf(
+				"%s (instances: %d, staged: %d, running: %d, healthy: %d, unhealthy: %d)",
+				app.ID,
+				app.Instances,
+				app.TasksStaged,
+				app.TasksRunning,
+				app.TasksHealthy,
+				app.TasksUnhealthy,
+			))
+		}
+	}
+	for _, group := range status.Groups {
+		unhealthy = append(unhealthy, marathonUnhealthyApps(group)...)
+	}
+	return unhealthy
+}
+
+// marathonDeploymentProgress describes the current step of a deployment
+func marathonDeploymentProgress(d marathonDeployment) string {
+	var actions []string
+	for _, action := range d.CurrentActions {
+		actions = append(actions, action.Action+" "+action.App)
+	}
+	progress := fmt.Sprintf("step %d/%d", d.CurrentStep, d.TotalSteps)
+	if len(actions) > 0 {
+		progress += ": " + strings.Join(actions, ", ")
+	}
+	return progress
+}
+
+// marathonWatch polls Marathon until the deployment in result has finished
+// and every app in the group is running & healthy. An error is returned if
+// this does not happen before the timeout.
+func marathonWatch(conf config, groupID string, result marathonResult, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	// Wait for the deployment to disappear from the deployment list
+	var lastProgress string
+	for {
+		deployments, err := marathonDeployments(conf)
+		if err != nil {
+			return err
+		}
+		var deployment *marathonDeployment
+		for i := range deployments {
+			if deployments[i].ID == result.DeploymentID {
+				deployment = &deployments[i]
+				break
+			}
+		}
+		if deployment == nil {
+			break
+		}
+		progress := marathonDeploymentProgress(*deployment)
+		if progress != lastProgress {
+			fmt.Fprintf(stdout, "Deployment %s: %s\n", result.DeploymentID, progress)
+			lastProgress = progress
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"Deployment %s did not finish within %s (%s)",
+				result.DeploymentID,
+				timeout,
+				progress,
+			)
+		}
+		time.Sleep(marathonWatchInterval)
+	}
+
+	// Wait for all apps in the group to be healthy
+	for {
+		status, err := marathonGroupGetStatus(conf, groupID)
+		if err != nil {
+			return err
+		}
+		if result.Version != "" && status.Version != "" && status.Version != result.Version {
+			return fmt.Errorf(
+				"Deployment %s did not complete. Group %s is at version %s, expected %s",
+				result.DeploymentID,
+				groupID,
+				status.Version,
+				result.Version,
+			)
+		}
+		unhealthy := marathonUnhealthyApps(status)
+		if len(unhealthy) == 0 {
+			fmt.Fprintf(stdout, "Deployment %s finished\n", result.DeploymentID)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(
+				"Apps not healthy within %s:\n* %s",
+				timeout,
+				strings.Join(unhealthy, "\n* "),
+			)
+		}
+		time.Sleep(marathonWatchInterval)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarathonUnhealthyApps(t *testing.T) {
+	tests := []struct {
+		json   string
+		expect []string
+	}{
+		// All running, no health checks
+		{
+			json:   `{"id":"/g","apps":[{"id":"/g/a","instances":2,"tasksRunning":2}]}`,
+			expect: nil,
+		},
+		// Running but health checks not yet passing
+		{
+			json:   `{"id":"/g","apps":[{"id":"/g/a","instances":2,"tasksRunning":2,"tasksHealthy":1,"healthChecks":[{}]}]}`,
+			expect: []string{"/g/a (instances: 2, staged: 0, running: 2, healthy: 1, unhealthy: 0)"},
+		},
+		// Unhealthy task in nested group
+		{
+			json:   `{"id":"/g","groups":[{"id":"/g/sub","apps":[{"id":"/g/sub/b","instances":1,"tasksRunning":1,"tasksHealthy":1,"tasksUnhealthy":1,"healthChecks":[{}]}]}]}`,
+			expect: []string{"/g/sub/b (instances: 1, staged: 0, running: 1, healthy: 1, unhealthy: 1)"},
+		},
+	}
+	for i, test := range tests {
+		var status marathonGroupStatus
+		if err := json.Unmarshal([]byte(test.json), &status); err != nil {
+			t.Fatalf("(%d) Unexpected error parsing JSON: %s", i, err)
+		}
+		got := marathonUnhealthyApps(status)
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("(%d) Expected %q, got %q", i, test.expect, got)
+		}
+	}
+}
+
+func TestMarathonDeploymentProgress(t *testing.T) {
+	var d marathonDeployment
+	err := json.Unmarshal([]byte(`{
+		"id": "97c136bf-5a28-4821-9d94-480d9fbb01c8",
+		"currentStep": 1,
+		"totalSteps": 2,
+		"currentActions": [{"action": "RestartApplication", "app": "/g/a"}]
+	}`), &d)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing JSON: %s", err)
+	}
+	expect := "step 1/2: RestartApplication /g/a"
+	if got := marathonDeploymentProgress(d); got != expect {
+		t.Errorf("Expected '%s', got '%s'", expect, got)
+	}
+}
+
+func TestMarathonWatch(t *testing.T) {
+	defer func(interval time.Duration, w io.Writer) {
+		marathonWatchInterval = interval
+		stdout = w
+	}(marathonWatchInterval, stdout)
+	marathonWatchInterval = time.Millisecond
+
+	running := `[{"id":"d1","currentStep":1,"totalSteps":2,"currentActions":[{"action":"RestartApplication","app":"/g/a"}]}]`
+	healthy := `{"id":"/g","version":"v2","apps":[{"id":"/g/a","instances":1,"tasksRunning":1}]}`
+	unhealthy := `{"id":"/g","version":"v2","apps":[{"id":"/g/a","instances":1,"tasksStaged":1}]}`
+	tests := []struct {
+		deployments []string // responses in order, the last is repeated
+		groups      []string
+		timeout     time.Duration
+		expect      string
+		err         string
+	}{
+		// Deployment finishes, then the apps become healthy
+		{
+			deployments: []string{running, running, `[]`},
+			groups:      []string{unhealthy, healthy},
+			timeout:     time.Minute,
+			expect:      "Deployment d1: step 1/2: RestartApplication /g/a\nDeployment d1 finished\n",
+		},
+		// Deployment replaced by another
+		{
+			deployments: []string{`[]`},
+			groups:      []string{`{"id":"/g","version":"v3"}`},
+			timeout:     time.Minute,
+			err:         "Deployment d1 did not complete. Group /g is at version v3, expected v2",
+		},
+		{
+			deployments: []string{running},
+			err:         "Deployment d1 did not finish within 0s (step 1/2: RestartApplication /g/a)",
+		},
+		{
+			deployments: []string{`[]`},
+			groups:      []string{unhealthy},
+			err:         "Apps not healthy within 0s:\n* /g/a (instances: 1, staged: 1, running: 0, healthy: 0, unhealthy: 0)",
+		},
+	}
+	for i, test := range tests {
+		respond := func(responses []string) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(responses[0])) // #nosec G104
+				if len(responses) > 1 {
+					responses = responses[1:]
+				}
+			}
+		}
+		c, done := marathonTestServer(t, map[string]http.HandlerFunc{
+			"GET /v2/deployments": respond(test.deployments),
+			"GET /v2/groups/g":    respond(test.groups),
+		})
+		var buf bytes.Buffer
+		stdout = &buf
+		err := marathonWatch(c, "/g", marathonResult{DeploymentID: "d1", Version: "v2"}, test.timeout)
+		done()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("(%d) Expected error '%s', got: %v", i, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(%d) Unexpected error: %s", i, err)
+		} else if got := buf.String(); got != test.expect {
+			t.Errorf("(%d) Expected output '%s', got '%s'", i, test.expect, got)
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 func promptConfirm(prompt string) bool {
 	var s string
 	for {
-		fmt.Printf("%s (y/n): ", prompt)
+		fmt.Fprintf(stdout, "%s (y/n): ", prompt)
 		_, err := fmt.Scanln(&s)
 		if err != nil {
 			panic(err)
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactHidden replaces secrets in output
+const redactHidden = "[hidden]"
+
+// redactMinLength is the shortest secret which is redacted, as replacing
+// very short values (e.g. "1") everywhere would make output unreadable
+const redactMinLength = 4
+
+// redactDefaultKeys are the (case insensitive) patterns of env vars, labels
+// & headers whose values are secret
+var redactDefaultKeys = []string{
+	"*TOKEN*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*SECRET*",
+	"*CREDENTIAL*",
+	"*APIKEY*",
+	"*API_KEY*",
+	"*API-KEY*",
+	"*PRIVATE_KEY*",
+	"*_KEY",
+	"AUTHORIZATION",
+	"PROXY-AUTHORIZATION",
+	"COOKIE",
+}
+
+// redactor collects the secrets to remove from output. Secrets are added
+// as they are found (e.g. when a token is fetched), so that they are hidden
+// wherever they are printed e.g. in an error message.
+var redactor struct {
+	sync.RWMutex
+	keys   []string
+	values []string
+}
+
+// stdout & stderr should be used for all output, so secrets are redacted
+var (
+	stdout io.Writer = redactWriter{os.Stdout}
+	stderr io.Writer = redactWriter{os.Stderr}
+)
+
+// redactAddKeys adds key patterns (e.g. "*_TOKEN") to the defaults
+func redactAddKeys(keys []string) {
+	redactor.Lock()
+	defer redactor.Unlock()
+	for _, key := range keys {
+		redactor.keys = append(redactor.keys, strings.ToUpper(key))
+	}
+}
+
+// redactKey returns true if the value of an env var, label or header with
+// this key is secret
+func redactKey(key string) bool {
+	key = strings.ToUpper(key)
+	redactor.RLock()
+	defer redactor.RUnlock()
+	for _, keys := range [][]string{redactDefaultKeys, redactor.keys} {
+		for _, pattern := range keys {
+			if ok, _ := path.Match(pattern, key); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactAddValue adds a secret value. Each line of a multi-line secret
+// (e.g. a private key) is added separately. The JSON encoded form of each
+// line is also added, as JSON output escapes characters such as & < > "
+func redactAddValue(value string) {
+	redactor.Lock()
+	defer redactor.Unlock()
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < redactMinLength {
+			continue
+		}
+		redactAppendValue(line)
+		if encoded, err := json.Marshal(line); err == nil {
+			redactAppendValue(string(encoded[1 : len(encoded)-1]))
+		}
+	}
+	// Replace longer values first, in case one secret contains another
+	sort.Slice(redactor.values, func(i, j int) bool {
+		return len(redactor.values[i]) > len(redactor.values[j])
+	})
+}
+
+// redactAppendValue adds a value to the redactor if it isn't already there.
+// The redactor must be locked.
+func redactAppendValue(value string) {
+	for _, v := range redactor.values {
+		if v == value {
+			return
+		}
+	}
+	redactor.values = append(redactor.values, value)
+}
+
+// redactHeaders adds the values of secret headers
+func redactHeaders(h http.Header) {
+	for key, values := range h {
+		if !redactKey(key) {
+			continue
+		}
+		for _, value := range values {
+			redactAddValue(value)
+			// Also hide the credentials without the scheme e.g. "Basic ..."
+			if i := strings.Index(value, " "); i >= 0 {
+				redactAddValue(value[i+1:])
+			}
+		}
+	}
+}
+
+// redactGroup returns a copy of a group with the values of secret env vars
+// & labels hidden. Env vars & labels are hidden by key rather than added to
+// the redactor, as their values are often common words (e.g. "true") which
+// would be replaced everywhere.
+func redactGroup(group marathonGroup) marathonGroup {
+	apps := make([]marathonApp, len(group.Apps))
+	for i, app := range group.Apps {
+		app.Env = redactMap(app.Env)
+		app.Labels = redactMap(app.Labels)
+		apps[i] = app
+	}
+	groups := make([]marathonGroup, len(group.Groups))
+	for i, g := range group.Groups {
+		groups[i] = redactGroup(g)
+	}
+	if group.Apps != nil {
+		group.Apps = apps
+	}
+	if group.Groups != nil {
+		group.Groups = groups
+	}
+	return group
+}
+
+// redactMap returns a copy of a map (e.g. an app's env) with the values of
+// secret keys hidden
+func redactMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	redacted := make(map[string]string, len(m))
+	for key, value := range m {
+		if redactKey(key) && value != "" {
+			value = redactHidden
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+// redactGroupJSON hides the secret env vars & labels in a group's JSON, for
+// printing
+func redactGroupJSON(data []byte) ([]byte, error) {
+	var group marathonGroup
+	err := json.Unmarshal(data, &group)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redactGroup(group), "", "    ")
+}
+
+// redactString replaces every secret value in s
+func redactString(s string) string {
+	redactor.RLock()
+	defer redactor.RUnlock()
+	for _, value := range redactor.values {
+		s = strings.Replace(s, value, redactHidden, -1)
+	}
+	return s
+}
+
+// redactWriter redacts secrets from everything written to it. Each write is
+// redacted separately, so a secret must be written in a single write (as
+// fmt.Fprintf & log do).
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	redactor.RLock()
+	n := len(redactor.values)
+	redactor.RUnlock()
+	if n == 0 {
+		return r.w.Write(p)
+	}
+	redacted := []byte(redactString(string(p)))
+	if bytes.Equal(redacted, p) {
+		return r.w.Write(p)
+	}
+	_, err := r.w.Write(redacted)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
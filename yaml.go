@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// yamlMaxDistance is the largest edit distance between an unknown field and
+// a known field for the known field to be suggested. Short fields must be
+// closer (a third of their length) so unrelated fields aren't suggested.
+const yamlMaxDistance = 2
+
+var (
+	yamlErrorLine    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	yamlUnknownField = regexp.MustCompile("^field (.+) not found in type (.+)$")
+	yamlWrongType    = regexp.MustCompile("^cannot unmarshal !!\\w+ `(.*)` into (.+)$")
+)
+
+// yamlUnmarshalStrict decodes YAML like yaml.UnmarshalStrict, so unknown
+// fields are errors. Each error is given on its own line as
+// "name:line:column: message" (where the column can be found), and unknown
+// fields are reported with the closest known field e.g.
+//
+//	deploy.yaml:12:7: unknown field tagTemplte (did you mean tagTemplate?)
+func yamlUnmarshalStrict(name string, data []byte, v interface{}) error {
+	err := yaml.UnmarshalStrict(data, v)
+	if err == nil {
+		return nil
+	}
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+	fields := map[string][]string{}
+	yamlFields(reflect.TypeOf(v), fields)
+	lines := strings.Split(string(data), "\n")
+	errors := make([]string, 0, len(messages))
+	for _, message := range messages {
+		errors = append(errors, yamlFormatError(name, lines, fields, message))
+	}
+	return fmt.Errorf("%s", strings.Join(errors, "\n"))
+}
+
+// yamlFormatError adds the position to a yaml error message, and makes
+// unknown field errors more helpful
+func yamlFormatError(name string, lines []string, fields map[string][]string, message string) string {
+	match := yamlErrorLine.FindStringSubmatch(message)
+	if match == nil {
+		return yamlPosition(name, 0, 0) + strings.TrimPrefix(message, "yaml: ")
+	}
+	line, _ := strconv.Atoi(match[1])
+	message = match[2]
+
+	// Find the column of the field or value
+	var find string
+	if m := yamlUnknownField.FindStringSubmatch(message); m != nil {
+		find = m[1]
+		message = "unknown field " + m[1]
+		if suggestion := yamlSuggest(m[1], fields[m[2]]); suggestion != "" {
+			message += " (did you mean " + suggestion + "?)"
+		}
+	} else if m := yamlWrongType.FindStringSubmatch(message); m != nil {
+		find = strings.TrimSuffix(m[1], "...")
+	}
+	column := 0
+	if find != "" && line > 0 && line <= len(lines) {
+		column = strings.Index(lines[line-1], find) + 1
+	}
+	return yamlPosition(name, line, column) + message
+}
+
+// yamlPosition formats a position in a file e.g. "deploy.yaml:12:7: ".
+// Unknown parts are omitted.
+func yamlPosition(name string, line, column int) string {
+	var parts []string
+	if name != "" {
+		parts = append(parts, name)
+	}
+	if line > 0 {
+		parts = append(parts, strconv.Itoa(line))
+		if column > 0 {
+			parts = append(parts, strconv.Itoa(column))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, ":") + ": "
+}
+
+// yamlFields collects the YAML field names of every struct type within t,
+// keyed by the type name used in yaml errors
+func yamlFields(t reflect.Type, fields map[string][]string) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		yamlFields(t.Elem(), fields)
+	case reflect.Struct:
+		if _, ok := fields[t.String()]; ok {
+			return
+		}
+		fields[t.String()] = nil // the struct may contain itself
+		fields[t.String()] = yamlStructFields(t, fields)
+	}
+}
+
+// yamlStructFields returns the YAML field names of a struct, including
+// those of inlined structs
+func yamlStructFields(t reflect.Type, fields map[string][]string) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			names = append(names, yamlStructFields(f.Type, fields)...)
+			continue
+		}
+		switch tag[0] {
+		case "-":
+			continue
+		case "":
+			names = append(names, strings.ToLower(f.Name))
+		default:
+			names = append(names, tag[0])
+		}
+		yamlFields(f.Type, fields)
+	}
+	return names
+}
+
+// yamlSuggest returns the known field closest to an unknown field, or "" if
+// none is close
+func yamlSuggest(field string, known []string) string {
+	max := len(field) / 3
+	if max > yamlMaxDistance {
+		max = yamlMaxDistance
+	}
+	best, bestDistance := "", max+1
+	for _, name := range known {
+		d := yamlDistance(strings.ToLower(field), strings.ToLower(name))
+		if d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// yamlDistance is the Levenshtein distance between two strings
+func yamlDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}